@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// envRe matches ${NAME} and ${NAME:-default}, $${ is a literal ${
+var envRe = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// loadSection decodes the section of the config file into v, or the whole
+// file if it has no such section, e.g. a file of a single command.
+func loadSection(path, section string, v any) error {
+	m, err := loadConfig(path)
+	if err != nil {
+		return err
+	}
+	var node any = m
+	if s, ok := m[section]; ok {
+		node = s
+	}
+	return decodeConfig(node, v)
+}
+
+// loadConfig reads the config file with its includes into a map.
+func loadConfig(path string) (map[string]any, error) {
+	return loadFile(path, make(map[string]bool))
+}
+
+// loadFile reads a config file, the format is chosen by the extension, JSON,
+// TOML, or YAML otherwise. The environment variables are expanded in the
+// string values after parsing. The files of include are loaded first,
+// relative to the file, and the file is merged over them.
+func loadFile(path string, loading map[string]bool) (map[string]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve config file %s: %w", path, err)
+	}
+	if loading[abs] {
+		return nil, fmt.Errorf("config file %s includes itself", path)
+	}
+	loading[abs] = true
+	defer delete(loading, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+
+	var m map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &m)
+	case ".toml":
+		err = toml.Unmarshal(data, &m)
+	default:
+		err = yaml.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config file %s: %w", path, err)
+	}
+	if m == nil {
+		m = make(map[string]any)
+	} else {
+		m = normalize(m).(map[string]any)
+	}
+	if err := expandEnv(m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return resolveIncludes(m, path, loading)
+}
+
+// resolveIncludes merges the map and its nested maps over the files of their
+// include, so a fragment could be included into a section too.
+func resolveIncludes(m map[string]any, path string, loading map[string]bool) (map[string]any, error) {
+	for k, v := range m {
+		if sub, ok := v.(map[string]any); ok {
+			sub, err := resolveIncludes(sub, path, loading)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = sub
+		}
+	}
+
+	var includes []string
+	switch v := m["include"].(type) {
+	case nil:
+		return m, nil
+	case string, envValue:
+		includes = []string{fmt.Sprint(v)}
+	case []any:
+		for _, inc := range v {
+			s, ok := inc.(string)
+			if e, isEnv := inc.(envValue); isEnv {
+				s, ok = string(e), true
+			}
+			if !ok {
+				return nil, fmt.Errorf("%s: include must be a path or a list of paths", path)
+			}
+			includes = append(includes, s)
+		}
+	default:
+		return nil, fmt.Errorf("%s: include must be a path or a list of paths", path)
+	}
+	delete(m, "include")
+
+	merged := make(map[string]any)
+	for _, inc := range includes {
+		if !filepath.IsAbs(inc) {
+			inc = filepath.Join(filepath.Dir(path), inc)
+		}
+		im, err := loadFile(inc, loading)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeConfig(merged, im)
+	}
+	return mergeConfig(merged, m), nil
+}
+
+// envValue is a string value with the environment variables expanded. Its
+// type is decided by the field it's decoded into, e.g. a number for heat_up.
+type envValue string
+
+// expandEnv expands the environment variables in the string values of the
+// map and the lists in it. The values are expanded after parsing, so they
+// could not change the structure of the config.
+func expandEnv(v any) error {
+	expand := func(e any) (any, error) {
+		s, ok := e.(string)
+		if !ok {
+			return e, expandEnv(e)
+		}
+		if !envRe.MatchString(s) {
+			return s, nil
+		}
+		s, err := expandString(s)
+		return envValue(s), err
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			x, err := expand(e)
+			if err != nil {
+				return err
+			}
+			v[k] = x
+		}
+	case []any:
+		for i, e := range v {
+			x, err := expand(e)
+			if err != nil {
+				return err
+			}
+			v[i] = x
+		}
+	}
+	return nil
+}
+
+// expandString replaces ${NAME} with the environment variable, or the default
+// of ${NAME:-default} if it's not set. An unset variable without default is
+// an error, so a typo is not silently empty.
+func expandString(s string) (string, error) {
+	var err error
+	s = envRe.ReplaceAllStringFunc(s, func(m string) string {
+		sub := envRe.FindStringSubmatch(m)
+		if sub[1] != "" {
+			// escaped
+			return m[1:]
+		}
+		if v, ok := os.LookupEnv(sub[2]); ok {
+			return v
+		}
+		if strings.Contains(m, ":-") {
+			return sub[3]
+		}
+		if err == nil {
+			err = fmt.Errorf("environment variable %s is not set", sub[2])
+		}
+		return m
+	})
+	return s, err
+}
+
+// mergeConfig merges over into base. The maps are merged key by key, the
+// lists are appended, e.g. the substitutions of a shared library followed by
+// the local ones, and the other values are replaced.
+func mergeConfig(base, over map[string]any) map[string]any {
+	for k, v := range over {
+		switch b := base[k].(type) {
+		case map[string]any:
+			if o, ok := v.(map[string]any); ok {
+				base[k] = mergeConfig(b, o)
+				continue
+			}
+		case []any:
+			if o, ok := v.([]any); ok {
+				base[k] = append(b, o...)
+				continue
+			}
+		}
+		base[k] = v
+	}
+	return base
+}
+
+// normalize converts the maps and lists decoded from any format into
+// map[string]any and []any, so they could be merged.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []any:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+		return v
+	case []map[string]any:
+		// arrays of tables of toml
+		l := make([]any, len(v))
+		for i, e := range v {
+			l[i] = normalize(e)
+		}
+		return l
+	}
+	return v
+}
+
+// decodeConfig decodes the merged config into v. It's converted into YAML
+// nodes, so the configs are decoded the same whatever the format of the
+// files.
+func decodeConfig(node any, v any) error {
+	n, err := configNode(node)
+	if err == nil {
+		err = n.Decode(v)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode config file: %w", err)
+	}
+	return nil
+}
+
+// configNode converts a value of the merged config into a YAML node. The
+// values are not encoded as text again, an expanded value stays one scalar.
+func configNode(v any) (*yaml.Node, error) {
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, k := range keys {
+			value, err := configNode(v[k])
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, value)
+		}
+		return n, nil
+	case []any:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, e := range v {
+			value, err := configNode(e)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, value)
+		}
+		return n, nil
+	case envValue:
+		// no tag, resolved by the field, e.g. a number
+		return &yaml.Node{Kind: yaml.ScalarNode, Value: string(v)}, nil
+	}
+
+	n := &yaml.Node{}
+	if err := n.Encode(v); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alexjx/gcodeproc/pkg/preheat"
+)
+
+// writeFiles writes the files into a temporary directory, and returns it
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// load loads the config file into the config of all the commands
+func load(t *testing.T, path string) *Config {
+	t.Helper()
+	m, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	var cfg Config
+	if err := decodeConfig(m, &cfg); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	return &cfg
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": "preheat:\n  defaults:\n    heat_up: 30\n  extruders:\n  - name: T0\n  - name: T1\n",
+		"config.json": `{"preheat": {"defaults": {"heat_up": 30}, "extruders": [{"name": "T0"}, {"name": "T1"}]}}`,
+		"config.toml": "[preheat.defaults]\nheat_up = 30\n[[preheat.extruders]]\nname = \"T0\"\n[[preheat.extruders]]\nname = \"T1\"\n",
+	})
+	for _, name := range []string{"config.yaml", "config.json", "config.toml"} {
+		t.Run(name, func(t *testing.T) {
+			cfg := load(t, filepath.Join(dir, name))
+			if cfg.Preheat == nil || cfg.Preheat.Defaults == nil || cfg.Preheat.Defaults.HeatUp != 30 {
+				t.Fatalf("heat up is not decoded: %+v", cfg.Preheat)
+			}
+			if len(cfg.Preheat.Extruders) != 2 || cfg.Preheat.Extruders[1].Name != "T1" {
+				t.Errorf("extruders are not decoded: %+v", cfg.Preheat.Extruders)
+			}
+		})
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"printer.yaml": `
+include: profiles/toolchanger.json
+substitute:
+  include: lib/subs.toml
+  substitutions:
+  - from: local
+    to: LOCAL
+preheat:
+  defaults:
+    heat_up: 40
+`,
+		"profiles/toolchanger.json": `{"preheat": {"defaults": {"heat_up": 30, "active_gcode": "M104"}, "extruders": [{"name": "T0"}]}}`,
+		// relative to the included file
+		"lib/subs.toml": "include = \"more.yaml\"\n[[substitutions]]\nfrom = \"lib\"\nto = \"LIB\"\n",
+		"lib/more.yaml": "substitutions:\n- from: more\n  to: MORE\n",
+	})
+	cfg := load(t, filepath.Join(dir, "printer.yaml"))
+
+	// the lists are appended, the included first
+	var from []string
+	for _, s := range cfg.Substitute.Substitutions {
+		from = append(from, s.From)
+	}
+	if got := strings.Join(from, ","); got != "more,lib,local" {
+		t.Errorf("substitutions %s, want more,lib,local", got)
+	}
+	// the maps are merged, the values replaced
+	d := cfg.Preheat.Defaults
+	if d.HeatUp != 40 || d.ActiveGcode != "M104" {
+		t.Errorf("defaults heat up %g active gcode %q, want 40 M104", d.HeatUp, d.ActiveGcode)
+	}
+	if len(cfg.Preheat.Extruders) != 1 {
+		t.Errorf("%d extruders, want 1", len(cfg.Preheat.Extruders))
+	}
+}
+
+func TestConfigIncludeErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"loop.yaml":    "include: loop2.yaml\n",
+		"loop2.yaml":   "include: [loop.yaml]\n",
+		"missing.yaml": "include: none.yaml\n",
+		"number.yaml":  "include: 1\n",
+	})
+	for name, want := range map[string]string{
+		"loop.yaml":    "includes itself",
+		"missing.yaml": "failed to open config file",
+		"number.yaml":  "include must be a path",
+	} {
+		_, err := loadConfig(filepath.Join(dir, name))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", name, err, want)
+		}
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	t.Setenv("GCODEPROC_TOOL", "T1")
+	t.Setenv("GCODEPROC_HEAT_UP", "25.5")
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `
+defaults:
+  heat_up: ${GCODEPROC_HEAT_UP}
+  active_gcode: M104 T{{.Index}} S${GCODEPROC_TEMP:-200} ; $${literal} {{ $t := 1 }}
+extruders:
+- name: T0
+- name: ${GCODEPROC_TOOL}
+`,
+		"config.json":  `{"defaults": {"heat_up": "${GCODEPROC_HEAT_UP_UNSET:-30}"}, "extruders": [{"name": "T0"}]}`,
+		"unset.yaml":   "extruders:\n- name: ${GCODEPROC_UNSET}\n",
+		"include.yaml": "include: ${GCODEPROC_TOOL}.yaml\n",
+		"T1.yaml":      "extruders:\n- name: T1\n",
+	})
+	section := func(name string) *preheat.Config {
+		t.Helper()
+		var cfg preheat.Config
+		if err := loadSection(filepath.Join(dir, name), "preheat", &cfg); err != nil {
+			t.Fatalf("%s: failed to load: %v", name, err)
+		}
+		return &cfg
+	}
+
+	cfg := section("config.yaml")
+	if cfg.Defaults.HeatUp != 25.5 {
+		t.Errorf("heat up %g, want 25.5", cfg.Defaults.HeatUp)
+	}
+	if want := "M104 T{{.Index}} S200 ; ${literal} {{ $t := 1 }}"; cfg.Defaults.ActiveGcode != want {
+		t.Errorf("active gcode %q, want %q", cfg.Defaults.ActiveGcode, want)
+	}
+	if cfg.Extruders[1].Name != "T1" {
+		t.Errorf("extruder %q, want T1", cfg.Extruders[1].Name)
+	}
+
+	// a quoted value is a number after the expansion
+	if cfg := section("config.json"); cfg.Defaults.HeatUp != 30 {
+		t.Errorf("heat up %g, want 30", cfg.Defaults.HeatUp)
+	}
+	if cfg := section("include.yaml"); len(cfg.Extruders) != 1 || cfg.Extruders[0].Name != "T1" {
+		t.Errorf("the include is not expanded: %+v", cfg.Extruders)
+	}
+
+	_, err := loadConfig(filepath.Join(dir, "unset.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "GCODEPROC_UNSET is not set") {
+		t.Errorf("error %v, want the unset variable", err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexjx/gcodeproc/pkg/preheat"
+	"github.com/urfave/cli/v2"
+)
+
+// processFile processes the gcode file into the file with the suffix, and
+// replaces the gcode file with it if rename is set.
+func processFile(gcodePath, suffix string, rename bool, process func(r io.Reader, w io.Writer) error) error {
+	gcodeFp, err := os.Open(gcodePath)
+	if err != nil {
+		return fmt.Errorf("failed to open gcode file: %w", err)
+	}
+	defer gcodeFp.Close()
+
+	outputPath := gcodePath + suffix
+	outputFp, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %w", err)
+	}
+	defer outputFp.Close()
+
+	w := bufio.NewWriter(outputFp)
+	if err := process(gcodeFp, w); err != nil {
+		outputFp.Close()
+		os.Remove(outputPath)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	gcodeFp.Close()
+	if err := outputFp.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+
+	if rename {
+		if err := os.Rename(outputPath, gcodePath); err != nil {
+			return fmt.Errorf("failed to rename output file: %w", err)
+		}
+	}
+	return nil
+}
+
+// simulate processes the gcode file without writing the output
+func simulate(gcodePath string, process func(r io.Reader, w io.Writer) error) error {
+	gcodeFp, err := os.Open(gcodePath)
+	if err != nil {
+		return fmt.Errorf("failed to open gcode file: %w", err)
+	}
+	defer gcodeFp.Close()
+	return process(gcodeFp, io.Discard)
+}
+
+// writeReport writes the report as CSV if the file ends with .csv, or JSON
+func writeReport(path string, r *preheat.Report) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create report file: %w", err)
+	}
+	defer fp.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		err = r.WriteCSV(fp)
+	} else {
+		err = r.WriteJSON(fp)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write report file: %w", err)
+	}
+	return fp.Close()
+}
+
+// precisionFlag returns the precision of the flag, nil if it's not set
+func precisionFlag(cctx *cli.Context) *int {
+	if !cctx.IsSet("precision") {
+		return nil
+	}
+	precision := cctx.Int("precision")
+	return &precision
+}
@@ -0,0 +1,178 @@
+package gcode
+
+import (
+	"strconv"
+	"strings"
+)
+
+// DefaultPrecision is the default decimal places of the edited numbers
+const DefaultPrecision = 5
+
+// Edited checks the line is changed after parsing. The untouched lines are
+// written as they were.
+func (l *Line) Edited() bool {
+	return l.edited
+}
+
+// Set sets a number param, it's appended if not given.
+func (l *Line) Set(key string, value float64) {
+	p := l.param(key)
+	p.Type = ParamNumber
+	p.Number = value
+	p.String = strconv.FormatFloat(value, 'f', -1, 64)
+	p.Raw = p.String
+	p.edited = true
+}
+
+// SetString sets a string param, it's appended if not given.
+func (l *Line) SetString(key, value string) {
+	p := l.param(key)
+	p.Type = ParamString
+	p.Number = 0
+	p.String = value
+	p.Raw = quote(value, p.Assign)
+	p.edited = true
+}
+
+// SetFlag sets a param without value, e.g. X of G28 X
+func (l *Line) SetFlag(key string) {
+	p := l.param(key)
+	p.Type = ParamFlag
+	p.Number = 0
+	p.String = ""
+	p.Raw = ""
+	p.edited = true
+}
+
+// Scale multiplies a number param, false if it's not a number param.
+func (l *Line) Scale(key string, f float64) bool {
+	v, ok := l.Float(key)
+	if !ok {
+		return false
+	}
+	l.Set(key, v*f)
+	return true
+}
+
+// Remove removes a param, false if it's not given.
+func (l *Line) Remove(key string) bool {
+	for i, p := range l.Params {
+		if strings.EqualFold(p.Key, key) {
+			l.Params = append(l.Params[:i], l.Params[i+1:]...)
+			l.edited = true
+			return true
+		}
+	}
+	return false
+}
+
+// SetComment sets the ; comment, without the semicolon.
+func (l *Line) SetComment(comment string) {
+	l.Comment = comment
+	l.HasComment = true
+	l.edited = true
+}
+
+// RemoveComment removes the ; comment.
+func (l *Line) RemoveComment() {
+	l.Comment = ""
+	l.HasComment = false
+	l.edited = true
+}
+
+// SetText sets the raw string of a message command, e.g. the message of M117
+func (l *Line) SetText(text string) {
+	l.Text = text
+	l.edited = true
+}
+
+// param returns the param of the key to edit, a new one is appended if it's
+// not given.
+func (l *Line) param(key string) *Param {
+	l.edited = true
+	if p := l.Param(key); p != nil {
+		return p
+	}
+	key = strings.ToUpper(key)
+	p := &Param{Key: key, Assign: l.Extended || len(key) > 1}
+	l.Params = append(l.Params, p)
+	return p
+}
+
+// String returns the line, the edited numbers with the default precision.
+func (l *Line) String() string {
+	return l.Format(DefaultPrecision)
+}
+
+// Format returns the line. An untouched line is the raw line, an edited one
+// is written from the fields with the edited numbers rounded to the decimal
+// places, the parenthesis comments are moved after the params and the
+// checksum is updated.
+func (l *Line) Format(precision int) string {
+	if !l.edited || l.Err != nil {
+		return l.Raw
+	}
+
+	var words []string
+	if l.HasLineNumber {
+		words = append(words, "N"+strconv.FormatInt(l.LineNumber, 10))
+	}
+	if l.Command != "" {
+		words = append(words, l.Command)
+	}
+	for _, p := range l.Params {
+		words = append(words, p.format(precision))
+	}
+	if l.Text != "" {
+		words = append(words, l.Text)
+	}
+	for _, c := range l.Parens {
+		words = append(words, "("+c+")")
+	}
+
+	s := strings.Join(words, " ")
+	if l.HasChecksum {
+		s += "*" + strconv.Itoa(Checksum(s))
+	}
+	if l.HasComment {
+		if s != "" {
+			s += " "
+		}
+		s += ";" + l.Comment
+	}
+	return s
+}
+
+func (p *Param) format(precision int) string {
+	value := p.Raw
+	if p.edited && p.Type == ParamNumber {
+		value = FormatNumber(p.Number, precision)
+	}
+	if p.Assign {
+		return p.Key + "=" + value
+	}
+	return p.Key + value
+}
+
+// FormatNumber formats a number with at most the decimal places, without
+// trailing zeros. The shortest exact form is used if precision is negative.
+func FormatNumber(v float64, precision int) string {
+	s := strconv.FormatFloat(v, 'f', precision, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+// quote quotes a string value if it could not be written as is
+func quote(s string, assign bool) string {
+	// a number of a letter param would be read back as a number
+	numeric := !assign && isNumber(s)
+	if s != "" && !numeric && !strings.ContainsAny(s, " \t;()\"'*=") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
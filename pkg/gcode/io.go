@@ -0,0 +1,121 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Reader reads the lines of a gcode file. The line endings are kept, so the
+// untouched lines are written back byte for byte.
+type Reader struct {
+	r      *bufio.Reader
+	lineNo int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next line, io.EOF at the end. A malformed line is
+// returned with its parse error in Err, it's kept as is.
+func (r *Reader) Read() (*Line, error) {
+	s, err := r.r.ReadString('\n')
+	if err != nil && (err != io.EOF || s == "") {
+		return nil, err
+	}
+	r.lineNo++
+
+	text := strings.TrimSuffix(s, "\n")
+	eol := s[len(text):]
+	if strings.HasSuffix(text, "\r") {
+		text = text[:len(text)-1]
+		eol = "\r" + eol
+	}
+
+	return ReadLine(text, eol, r.lineNo), nil
+}
+
+// ReadLine parses a line of a file, the text without the line ending, which
+// is empty for the last line without one. A malformed line is kept as is,
+// with the parse error in Err.
+func ReadLine(text, eol string, lineNo int64) *Line {
+	l, err := Parse(text)
+	if err != nil {
+		l = &Line{Raw: text, Err: &ParseError{LineNo: lineNo, Err: err}}
+	}
+	l.EOL = eol
+	l.noEOL = eol == ""
+	return l
+}
+
+// LineNo returns the line number of the last line read, starts from 1
+func (r *Reader) LineNo() int64 {
+	return r.lineNo
+}
+
+// ParseError is the error of a malformed line
+type ParseError struct {
+	LineNo int64
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.LineNo, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Writer writes the lines, the untouched ones as they were read.
+type Writer struct {
+	w *bufio.Writer
+
+	// decimal places of the edited numbers
+	Precision int
+	// line ending of the new lines
+	EOL string
+
+	// the last line has no line ending, it's added if another line follows
+	pendingEOL bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w), Precision: DefaultPrecision, EOL: "\n"}
+}
+
+// Write writes a line with its line ending, EOL for the new lines. The last
+// line of a file without line ending is kept so, unless a line follows it.
+func (w *Writer) Write(l *Line) error {
+	eol := l.EOL
+	if eol == "" && !l.noEOL {
+		eol = w.EOL
+	}
+	return w.write(l.Format(w.Precision), eol)
+}
+
+// WriteString writes a new line as is, e.g. an inserted gcode
+func (w *Writer) WriteString(s string) error {
+	return w.write(s, w.EOL)
+}
+
+func (w *Writer) write(s, eol string) error {
+	if w.pendingEOL {
+		if _, err := w.w.WriteString(w.EOL); err != nil {
+			return err
+		}
+	}
+	w.pendingEOL = eol == ""
+	if _, err := w.w.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.w.WriteString(eol)
+	return err
+}
+
+// Flush writes the buffered data to the underlying writer
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,162 @@
+package gcode
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readAll reads all the lines of the gcode
+func readAll(t *testing.T, s string) []*Line {
+	t.Helper()
+	r := NewReader(strings.NewReader(s))
+	var lines []*Line
+	for {
+		l, err := r.Read()
+		if err == io.EOF {
+			return lines
+		}
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		lines = append(lines, l)
+	}
+}
+
+// writeAll writes the lines with the writer
+func writeAll(t *testing.T, lines []*Line, write func(w *Writer) error) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	for _, l := range lines {
+		if err := w.Write(l); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	if write != nil {
+		if err := write(w); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	return b.String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		lines int
+	}{
+		{name: "empty", input: ""},
+		{name: "lf", input: "G1 X10\nG1 Y20\n", lines: 2},
+		{name: "crlf", input: "G1 X10\r\nM117 hi there \r\n", lines: 2},
+		{name: "mixed", input: "G1 X10\r\nG1 Y20\n\r\n", lines: 3},
+		{name: "no trailing eol", input: "G1 X10\nG1 Y20", lines: 2},
+		{name: "no trailing eol crlf", input: "G1 X10\r\nG1 Y20", lines: 2},
+		{name: "blank lines", input: "\n\n  \n", lines: 3},
+		{name: "spacing", input: "  g1   x10.500 y-0 ;  Keep  \t \n", lines: 1},
+		{name: "comments", input: "; header\nG1 X1 (a) ; b\n;\n", lines: 3},
+		{name: "checksum", input: "N1 G1 X10*80\nN2 M117 Hi there*105\n", lines: 2},
+		{name: "malformed", input: "G1 (oops\nG1 X1\n", lines: 2},
+		{name: "long line", input: "; " + strings.Repeat("x", 100000) + "\nG1 X1\n", lines: 2},
+		{name: "carriage return only", input: "G1 X1\r", lines: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := readAll(t, tt.input)
+			if len(lines) != tt.lines {
+				t.Fatalf("%d lines read, want %d", len(lines), tt.lines)
+			}
+			if out := writeAll(t, lines, nil); out != tt.input {
+				t.Errorf("written %q, want %q", out, tt.input)
+			}
+		})
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	lines := readAll(t, "G1 X1\nG1 (oops\n")
+	if lines[0].Err != nil {
+		t.Errorf("line 1: %v", lines[0].Err)
+	}
+	perr, ok := lines[1].Err.(*ParseError)
+	if !ok || perr.LineNo != 2 {
+		t.Errorf("line 2 error = %v, want a parse error of line 2", lines[1].Err)
+	}
+}
+
+func TestWriteEdited(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		edit   func(lines []*Line)
+		write  func(w *Writer) error
+		output string
+	}{
+		{
+			name:  "keeps crlf",
+			input: "G1 X10 Y20\r\nG1 X1\r\n",
+			edit: func(lines []*Line) {
+				lines[0].Set("X", 1.0/3)
+				lines[0].Remove("Y")
+			},
+			output: "G1 X0.33333\r\nG1 X1\r\n",
+		},
+		{
+			name:  "updates checksum",
+			input: "N1 G1 X10*80 ; sent\n",
+			edit: func(lines []*Line) {
+				lines[0].Set("X", 20)
+			},
+			output: "N1 G1 X20*" + strconv.Itoa(Checksum("N1 G1 X20")) + " ; sent\n",
+		},
+		{
+			name:  "quotes strings",
+			input: "RESPOND MSG=hi\n",
+			edit: func(lines []*Line) {
+				lines[0].SetString("MSG", `say "hi"`)
+			},
+			output: "RESPOND MSG=\"say \"\"hi\"\"\"\n",
+		},
+		{
+			name:  "new line",
+			input: "G1 X1\r\n",
+			write: func(w *Writer) error {
+				w.EOL = "\r\n"
+				return w.Write(NewLine("M400"))
+			},
+			output: "G1 X1\r\nM400\r\n",
+		},
+		{
+			// the last line gets an eol when a line follows it
+			name:  "after no trailing eol",
+			input: "G1 X1\r\nG1 X2",
+			write: func(w *Writer) error {
+				w.EOL = "\r\n"
+				if err := w.Write(NewLine("M400")); err != nil {
+					return err
+				}
+				return w.WriteString("M84")
+			},
+			output: "G1 X1\r\nG1 X2\r\nM400\r\nM84\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := readAll(t, tt.input)
+			if tt.edit != nil {
+				tt.edit(lines)
+			}
+			if out := writeAll(t, lines, tt.write); out != tt.output {
+				t.Errorf("written %q, want %q", out, tt.output)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Package gcode parses lines of gcode, the traditional letter params, klipper
+// extended commands with KEY=VALUE params, message commands, line numbers with
+// checksums, and comments.
+package gcode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TokenKind is the kind of a token
+type TokenKind int
+
+const (
+	TokenEOF      TokenKind = iota
+	TokenWord               // a word, e.g. G1, X10, NAME="a b"
+	TokenComment            // ; comment to the end of the line
+	TokenParen              // (comment)
+	TokenChecksum           // *45, the checksum of the line
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case TokenEOF:
+		return "EOF"
+	case TokenWord:
+		return "word"
+	case TokenComment:
+		return "comment"
+	case TokenParen:
+		return "paren"
+	case TokenChecksum:
+		return "checksum"
+	}
+	return fmt.Sprintf("TokenKind(%d)", int(k))
+}
+
+// Token is a token of a line. The text of comments is without the
+// delimiters, and the text of checksum is without the star.
+type Token struct {
+	Kind TokenKind
+	Text string
+	Pos  int // byte offset in the line
+}
+
+// Lexer splits a line into tokens
+type Lexer struct {
+	src string
+	pos int
+}
+
+func NewLexer(line string) *Lexer {
+	return &Lexer{src: line}
+}
+
+// Next returns the next token, TokenEOF at the end of the line.
+func (l *Lexer) Next() (Token, error) {
+	l.skipSpace()
+	if l.pos >= len(l.src) {
+		return Token{Kind: TokenEOF, Pos: l.pos}, nil
+	}
+
+	start := l.pos
+	switch c := l.src[l.pos]; {
+	case c == ';':
+		l.pos = len(l.src)
+		return Token{Kind: TokenComment, Text: l.src[start+1:], Pos: start}, nil
+	case c == '(':
+		end := strings.IndexByte(l.src[start:], ')')
+		if end < 0 {
+			return Token{}, fmt.Errorf("unterminated comment at %d", start)
+		}
+		l.pos = start + end + 1
+		return Token{Kind: TokenParen, Text: l.src[start+1 : start+end], Pos: start}, nil
+	case c == '*' && l.checksumAt(start):
+		l.pos++
+		for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+			l.pos++
+		}
+		return Token{Kind: TokenChecksum, Text: l.src[start+1 : l.pos], Pos: start}, nil
+	}
+
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if isSpace(c) || c == ';' || c == '(' || (c == '*' && l.checksumAt(l.pos)) {
+			break
+		}
+		// quoted strings could have spaces, e.g. MSG="a b" or P"file.g"
+		if c == '"' || (c == '\'' && l.pos > start && l.src[l.pos-1] == '=') {
+			if err := l.skipQuoted(c); err != nil {
+				return Token{}, err
+			}
+			continue
+		}
+		l.pos++
+	}
+	return Token{Kind: TokenWord, Text: l.src[start:l.pos], Pos: start}, nil
+}
+
+// Rest returns the raw text up to the comment or the checksum, e.g. the
+// message of M117. The lexer continues from there.
+func (l *Lexer) Rest() Token {
+	l.skipSpace()
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == ';' || (c == '*' && l.checksumAt(l.pos)) {
+			break
+		}
+		l.pos++
+	}
+	return Token{Kind: TokenWord, Text: strings.TrimRight(l.src[start:l.pos], " \t"), Pos: start}
+}
+
+// checksumAt checks a star at the position is followed by the checksum, and
+// nothing but a comment after it.
+func (l *Lexer) checksumAt(pos int) bool {
+	i := pos + 1
+	for i < len(l.src) && isDigit(l.src[i]) {
+		i++
+	}
+	if i == pos+1 {
+		return false
+	}
+	for i < len(l.src) && isSpace(l.src[i]) {
+		i++
+	}
+	return i == len(l.src) || l.src[i] == ';'
+}
+
+// skipQuoted skips a quoted string, a doubled quote is an escaped quote
+func (l *Lexer) skipQuoted(quote byte) error {
+	start := l.pos
+	l.pos++
+	for l.pos < len(l.src) {
+		if l.src[l.pos] == quote {
+			if l.pos+1 < len(l.src) && l.src[l.pos+1] == quote {
+				l.pos += 2
+				continue
+			}
+			l.pos++
+			return nil
+		}
+		l.pos++
+	}
+	return fmt.Errorf("unterminated string at %d", start)
+}
+
+func (l *Lexer) skipSpace() {
+	for l.pos < len(l.src) && isSpace(l.src[l.pos]) {
+		l.pos++
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
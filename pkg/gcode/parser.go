@@ -0,0 +1,380 @@
+package gcode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MessageCommands are the commands taking the rest of the line as a raw
+// string, instead of params, e.g. M117 Hello World.
+var MessageCommands = map[string]bool{
+	"M23":  true, // select sd file
+	"M28":  true, // start sd write
+	"M30":  true, // delete sd file
+	"M32":  true, // select and start sd file
+	"M117": true, // display message
+	"M118": true, // serial print
+	"M928": true, // start sd logging
+}
+
+// ParamType is the type of the value of a param
+type ParamType int
+
+const (
+	ParamFlag   ParamType = iota // a letter without value, e.g. X of G28 X
+	ParamNumber                  // a number, e.g. X10.5 or Z_ADJUST=0.1
+	ParamString                  // a string, e.g. NAME=foo or P"file.g"
+)
+
+// Param is a param of a command, a letter param or a KEY=VALUE param
+type Param struct {
+	Key    string // upper case letter, or the key of a KEY=VALUE param
+	Type   ParamType
+	Number float64
+	String string // value of a string param, unquoted
+	Raw    string // value as written, e.g. 10.50 or "a b"
+	Assign bool   // written as KEY=VALUE
+
+	edited bool // the value is formatted by the writer
+}
+
+// Line is a parsed line of gcode
+type Line struct {
+	Raw string // original line
+
+	LineNumber    int64 // N123
+	HasLineNumber bool
+
+	Command  string // upper case, e.g. G1, T0, EXCLUDE_OBJECT_START, empty without command
+	Extended bool   // klipper extended command, the params are KEY=VALUE
+	Params   []*Param
+	Text     string // raw string of the message commands, e.g. the message of M117
+
+	Checksum    int // *45
+	HasChecksum bool
+
+	Comment    string   // ; comment, without the semicolon
+	HasComment bool     // the comment could be empty
+	Parens     []string // (comments), without the parentheses
+
+	// parse error of a malformed line, the line is kept as is
+	Err error
+	// line ending, \n if empty
+	EOL string
+
+	checksumPos int  // position of the star
+	edited      bool // written by the fields instead of the raw line
+	noEOL       bool // the last line of a file without line ending
+}
+
+// Param returns the param of the key, nil if it's not given
+func (l *Line) Param(key string) *Param {
+	for _, p := range l.Params {
+		if strings.EqualFold(p.Key, key) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Has checks the param of the key is given
+func (l *Line) Has(key string) bool {
+	return l.Param(key) != nil
+}
+
+// Float returns the value of a number param
+func (l *Line) Float(key string) (float64, bool) {
+	p := l.Param(key)
+	if p == nil || p.Type != ParamNumber {
+		return 0, false
+	}
+	return p.Number, true
+}
+
+// ChecksumValid checks the checksum of the line, false without checksum
+func (l *Line) ChecksumValid() bool {
+	return l.HasChecksum && Checksum(l.Raw[:l.checksumPos]) == l.Checksum
+}
+
+// Checksum returns the checksum of a line, the xor of all the bytes before
+// the star
+func Checksum(s string) int {
+	var sum byte
+	for i := 0; i < len(s); i++ {
+		sum ^= s[i]
+	}
+	return int(sum)
+}
+
+// Parse parses a line of gcode.
+func Parse(line string) (*Line, error) {
+	p := &parser{lexer: NewLexer(line), line: &Line{Raw: line}}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.line, nil
+}
+
+// NewLine parses a new line, e.g. a gcode to insert. A malformed line is
+// kept as is, with the parse error in Err.
+func NewLine(text string) *Line {
+	l, err := Parse(text)
+	if err != nil {
+		return &Line{Raw: text, Err: err}
+	}
+	return l
+}
+
+type parser struct {
+	lexer *Lexer
+	line  *Line
+
+	// tokens to return before the lexer, e.g. words split from a packed word
+	pending []Token
+}
+
+func (p *parser) next() (Token, error) {
+	if len(p.pending) > 0 {
+		tok := p.pending[0]
+		p.pending = p.pending[1:]
+		return tok, nil
+	}
+	tok, err := p.lexer.Next()
+	if err != nil {
+		return tok, err
+	}
+	if tok.Kind == TokenWord && isPacked(tok.Text) {
+		// split after the first word, e.g. G1X10Y20 into G1, X10 and Y20
+		first := wordLen(tok.Text)
+		for i := first; i < len(tok.Text); {
+			n := wordLen(tok.Text[i:])
+			p.pending = append(p.pending, Token{Kind: TokenWord, Text: tok.Text[i : i+n], Pos: tok.Pos + i})
+			i += n
+		}
+		tok.Text = tok.Text[:first]
+	}
+	return tok, nil
+}
+
+func (p *parser) unread(tok Token) {
+	p.pending = append([]Token{tok}, p.pending...)
+}
+
+func (p *parser) parse() error {
+	l := p.line
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+
+		switch tok.Kind {
+		case TokenEOF:
+			return nil
+		case TokenComment:
+			l.Comment = tok.Text
+			l.HasComment = true
+		case TokenParen:
+			l.Parens = append(l.Parens, tok.Text)
+		case TokenChecksum:
+			sum, err := strconv.Atoi(tok.Text)
+			if err != nil {
+				return fmt.Errorf("malformed checksum %q", tok.Text)
+			}
+			l.Checksum = sum
+			l.HasChecksum = true
+			l.checksumPos = tok.Pos
+		case TokenWord:
+			switch {
+			case l.Command == "" && !l.HasLineNumber && isLineNumber(tok.Text):
+				n, err := strconv.ParseInt(tok.Text[1:], 10, 64)
+				if err != nil {
+					return fmt.Errorf("malformed line number %q", tok.Text)
+				}
+				l.LineNumber = n
+				l.HasLineNumber = true
+			case l.Command == "":
+				if err := p.command(tok.Text); err != nil {
+					return err
+				}
+			default:
+				if err := p.param(tok.Text); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (p *parser) command(word string) error {
+	l := p.line
+	switch {
+	case isPacked(word):
+		l.Command = strings.ToUpper(word)
+	case isExtended(word):
+		l.Command = strings.ToUpper(word)
+		l.Extended = true
+	default:
+		return fmt.Errorf("malformed command %q", word)
+	}
+
+	if MessageCommands[l.Command] {
+		if len(p.pending) > 0 {
+			// e.g. M117Hello, which is not a packed word
+			return fmt.Errorf("malformed command %q", word+p.pending[0].Text)
+		}
+		l.Text = p.lexer.Rest().Text
+	}
+	return nil
+}
+
+func (p *parser) param(word string) error {
+	l := p.line
+	if l.Params == nil {
+		// enough for most of the moves, e.g. G1 X Y E F
+		l.Params = make([]*Param, 0, 4)
+	}
+
+	// KEY=VALUE params, extended commands take only them
+	if i := strings.IndexByte(word, '='); i > 0 && !strings.ContainsAny(word[:i], `"'`) {
+		param := newParam(strings.ToUpper(word[:i]), word[i+1:])
+		param.Assign = true
+		if param.Type == ParamFlag {
+			// KEY= is an empty string
+			param.Type = ParamString
+		}
+		l.Params = append(l.Params, param)
+		return nil
+	}
+	if l.Extended {
+		l.Params = append(l.Params, &Param{Key: strings.ToUpper(word), Type: ParamFlag})
+		return nil
+	}
+
+	if !isLetter(word[0]) {
+		return fmt.Errorf("malformed param %q", word)
+	}
+	value := word[1:]
+	if value == "" {
+		// the value might be separated from the letter, e.g. X 10
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		if tok.Kind == TokenWord && isNumber(tok.Text) {
+			value = tok.Text
+		} else {
+			p.unread(tok)
+		}
+	}
+	l.Params = append(l.Params, newParam(strings.ToUpper(word[:1]), value))
+	return nil
+}
+
+// newParam types the value of a param
+func newParam(key, value string) *Param {
+	param := &Param{Key: key, Raw: value}
+	switch {
+	case value == "":
+		param.Type = ParamFlag
+	case isNumber(value):
+		param.Type = ParamNumber
+		param.Number, _ = strconv.ParseFloat(value, 64)
+		param.String = value
+	case len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0]:
+		quote := value[:1]
+		param.Type = ParamString
+		param.String = strings.ReplaceAll(value[1:len(value)-1], quote+quote, quote)
+	default:
+		param.Type = ParamString
+		param.String = value
+	}
+	return param
+}
+
+func isLineNumber(word string) bool {
+	if len(word) < 2 || (word[0] != 'N' && word[0] != 'n') {
+		return false
+	}
+	for i := 1; i < len(word); i++ {
+		if !isDigit(word[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// numberLen returns the length of the number at the start, e.g. -1.5 or .5,
+// 0 if there is none
+func numberLen(s string) int {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	start := i
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	digits := i > start
+	if i < len(s) && s[i] == '.' {
+		i++
+		frac := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		digits = digits || i > frac
+	}
+	if !digits {
+		return 0
+	}
+	return i
+}
+
+// isNumber checks the string is a number, e.g. 10, -1.5 or .5
+func isNumber(s string) bool {
+	n := numberLen(s)
+	return n > 0 && n == len(s)
+}
+
+// wordLen returns the length of the letter with a number at the start, e.g.
+// X10 of X10Y20, 0 if there is none
+func wordLen(s string) int {
+	if len(s) < 2 || !isLetter(s[0]) {
+		return 0
+	}
+	if n := numberLen(s[1:]); n > 0 {
+		return n + 1
+	}
+	return 0
+}
+
+// isPacked checks the string is a letter with a number, or several packed
+// without spaces, e.g. G1X10Y20
+func isPacked(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); {
+		n := wordLen(s[i:])
+		if n == 0 {
+			return false
+		}
+		i += n
+	}
+	return true
+}
+
+// isExtended checks the string is a klipper extended command, e.g.
+// EXCLUDE_OBJECT_START
+func isExtended(s string) bool {
+	if s == "" || !(isLetter(s[0]) || s[0] == '_') {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isLetter(s[i]) && !isDigit(s[i]) && s[i] != '_' {
+			return false
+		}
+	}
+	return true
+}
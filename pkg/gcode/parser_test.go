@@ -0,0 +1,149 @@
+package gcode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	num := func(key string, v float64) Param {
+		return Param{Key: key, Type: ParamNumber, Number: v}
+	}
+	str := func(key, s string) Param {
+		return Param{Key: key, Type: ParamString, String: s}
+	}
+	assign := func(p Param) Param {
+		p.Assign = true
+		return p
+	}
+	flag := func(key string) Param {
+		return Param{Key: key, Type: ParamFlag}
+	}
+
+	tests := []struct {
+		line     string
+		command  string
+		extended bool
+		params   []Param
+		text     string
+		comment  string
+		parens   []string
+		number   int64 // line number, -1 without
+		checksum bool  // a valid checksum is given
+	}{
+		{line: "", number: -1},
+		{line: "; only a comment", comment: " only a comment", number: -1},
+		{line: "G1 X10 Y-2.5 E.4 F1800", command: "G1", params: []Param{num("X", 10), num("Y", -2.5), num("E", 0.4), num("F", 1800)}, number: -1},
+		{line: "g1 x10", command: "G1", params: []Param{num("X", 10)}, number: -1},
+		{line: "G1X10Y20", command: "G1", params: []Param{num("X", 10), num("Y", 20)}, number: -1},
+		{line: "G1 X10Y20E+1.5", command: "G1", params: []Param{num("X", 10), num("Y", 20), num("E", 1.5)}, number: -1},
+		{line: "G1 X-.5 Y3. Z+0", command: "G1", params: []Param{num("X", -0.5), num("Y", 3), num("Z", 0)}, number: -1},
+		{line: "G1 X 10 Y20", command: "G1", params: []Param{num("X", 10), num("Y", 20)}, number: -1},
+		{line: "G28 X Y", command: "G28", params: []Param{flag("X"), flag("Y")}, number: -1},
+		{line: "T1", command: "T1", number: -1},
+		{line: "G1 X10 ; move", command: "G1", params: []Param{num("X", 10)}, comment: " move", number: -1},
+		{line: "G1 (first) X10 (second)", command: "G1", params: []Param{num("X", 10)}, parens: []string{"first", "second"}, number: -1},
+		{line: "N1 G1 X10*80", command: "G1", params: []Param{num("X", 10)}, number: 1, checksum: true},
+		{line: "N1 G1 X10*81", command: "G1", params: []Param{num("X", 10)}, number: 1},
+		{line: "N1G1X10*80 ; sent", command: "G1", params: []Param{num("X", 10)}, comment: " sent", number: 1, checksum: true},
+		{line: "N2 M117 Hi there*105", command: "M117", text: "Hi there", number: 2, checksum: true},
+		{line: "M117 Layer 2 (of 10) ; comment", command: "M117", text: "Layer 2 (of 10)", comment: " comment", number: -1},
+		{line: "M118 X10 Y20", command: "M118", text: "X10 Y20", number: -1},
+		{line: "M23 /sd/a b.gco", command: "M23", text: "/sd/a b.gco", number: -1},
+		{line: `M98 P"macro file.g"`, command: "M98", params: []Param{str("P", "macro file.g")}, number: -1},
+		{line: `M98 P"say ""hi"""`, command: "M98", params: []Param{str("P", `say "hi"`)}, number: -1},
+		{
+			line: `SET_FAN_SPEED FAN=part_fan SPEED=0.5`, command: "SET_FAN_SPEED", extended: true,
+			params: []Param{assign(str("FAN", "part_fan")), assign(num("SPEED", 0.5))}, number: -1,
+		},
+		{
+			line: `RESPOND MSG="a b; c" TYPE='it''s' PREFIX=`, command: "RESPOND", extended: true,
+			params: []Param{assign(str("MSG", "a b; c")), assign(str("TYPE", "it's")), assign(str("PREFIX", ""))}, number: -1,
+		},
+		{line: "EXCLUDE_OBJECT_START NAME=part_1 ; obj", command: "EXCLUDE_OBJECT_START", extended: true, params: []Param{assign(str("NAME", "part_1"))}, comment: " obj", number: -1},
+		{line: "PAUSE", command: "PAUSE", extended: true, number: -1},
+		{line: "M104 S200 T1", command: "M104", params: []Param{num("S", 200), num("T", 1)}, number: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			l, err := Parse(tt.line)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if l.Raw != tt.line {
+				t.Errorf("raw = %q", l.Raw)
+			}
+			if l.Command != tt.command || l.Extended != tt.extended {
+				t.Errorf("command = %q extended %v, want %q %v", l.Command, l.Extended, tt.command, tt.extended)
+			}
+			var params []Param
+			for _, p := range l.Params {
+				params = append(params, Param{Key: p.Key, Type: p.Type, Number: p.Number, Assign: p.Assign})
+				if p.Type == ParamString {
+					params[len(params)-1].String = p.String
+				}
+			}
+			if !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("params = %+v, want %+v", params, tt.params)
+			}
+			if l.Text != tt.text {
+				t.Errorf("text = %q, want %q", l.Text, tt.text)
+			}
+			if l.Comment != tt.comment || l.HasComment != (tt.comment != "") {
+				t.Errorf("comment = %q, want %q", l.Comment, tt.comment)
+			}
+			if !reflect.DeepEqual(l.Parens, tt.parens) {
+				t.Errorf("parens = %q, want %q", l.Parens, tt.parens)
+			}
+			number := int64(-1)
+			if l.HasLineNumber {
+				number = l.LineNumber
+			}
+			if number != tt.number {
+				t.Errorf("line number = %d, want %d", number, tt.number)
+			}
+			if l.ChecksumValid() != tt.checksum {
+				t.Errorf("checksum valid = %v, want %v", l.ChecksumValid(), tt.checksum)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, line := range []string{
+		"G1 (unterminated",
+		`M98 P"unterminated`,
+		"M117X10",
+		"G1 X10 =5",
+		"1G1",
+	} {
+		t.Run(line, func(t *testing.T) {
+			if _, err := Parse(line); err == nil {
+				t.Errorf("no error")
+			}
+			l := NewLine(line)
+			if l.Err == nil || l.String() != line {
+				t.Errorf("malformed line = %q err %v, want it kept as is", l.String(), l.Err)
+			}
+		})
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	for _, line := range []string{
+		"G1 X100.123 Y50.456 E0.03221 F1800",
+		"G1X100.123Y50.456E0.03221",
+		"SET_VELOCITY_LIMIT ACCEL=5000 SQUARE_CORNER_VELOCITY=5",
+		";TYPE:External perimeter",
+	} {
+		b.Run(line, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Parse(line); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+// Package pipeline streams the lines of a gcode file through the processors
+// in order, with one read and one write of the file.
+package pipeline
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+)
+
+// Emit outputs a line to the next processor, or to the output
+type Emit func(line *gcode.Line) error
+
+// Processor processes the lines of a gcode file. The lines are pushed in
+// order, parsed once, and the processor emits its output lines, immediately
+// or later, e.g. after the whole file is seen. The lines passed through are
+// emitted as they are, so they are written as they were read. Flush is
+// called after the last line.
+type Processor interface {
+	Push(line *gcode.Line, emit Emit) error
+	Flush(emit Emit) error
+}
+
+// Pipeline chains the processors, the output lines of each processor are
+// pushed to the next one.
+type Pipeline struct {
+	Processors []Processor
+}
+
+func New(processors ...Processor) *Pipeline {
+	return &Pipeline{Processors: processors}
+}
+
+func (p *Pipeline) Push(line *gcode.Line, emit Emit) error {
+	return p.push(0, line, emit)
+}
+
+// Flush flushes the processors in order, so the lines emitted by a processor
+// reach the ones after it before they are flushed.
+func (p *Pipeline) Flush(emit Emit) error {
+	for i, proc := range p.Processors {
+		next := func(line *gcode.Line) error {
+			return p.push(i+1, line, emit)
+		}
+		if err := proc.Flush(next); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// push pushes the line to the processor at the index, or emits it after
+// the last one
+func (p *Pipeline) push(i int, line *gcode.Line, emit Emit) error {
+	if i >= len(p.Processors) {
+		return emit(line)
+	}
+	return p.Processors[i].Push(line, func(line *gcode.Line) error {
+		return p.push(i+1, line, emit)
+	})
+}
+
+// Options are the settings of the output
+type Options struct {
+	Precision *int // decimal places of the edited numbers, gcode.DefaultPrecision if nil
+}
+
+// Run reads the lines, processes them, and writes the output lines. The line
+// endings are kept, the new lines take the one of the file. The options could
+// be nil for the defaults.
+func Run(r io.Reader, w io.Writer, proc Processor, opts *Options) error {
+	gr := gcode.NewReader(r)
+	gw := gcode.NewWriter(w)
+	if opts != nil && opts.Precision != nil {
+		gw.Precision = *opts.Precision
+	}
+	for {
+		line, err := gr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read gcode file: %w", err)
+		}
+		if gr.LineNo() == 1 && line.EOL != "" {
+			gw.EOL = line.EOL
+		}
+		if err := proc.Push(line, gw.Write); err != nil {
+			return err
+		}
+	}
+	if err := proc.Flush(gw.Write); err != nil {
+		return err
+	}
+	if err := gw.Flush(); err != nil {
+		return fmt.Errorf("failed to write gcode: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+	"github.com/alexjx/gcodeproc/pkg/timeline"
+)
+
+// scale scales the E of the moves
+type scale float64
+
+func (s scale) Push(line *gcode.Line, emit Emit) error {
+	if line.Command == "G1" {
+		line.Scale("E", float64(s))
+	}
+	return emit(line)
+}
+
+func (s scale) Flush(emit Emit) error {
+	return nil
+}
+
+// hold reads the whole file into a timeline before it emits any line, like
+// preheat and schedule
+type hold struct {
+	*timeline.Timeline
+}
+
+func (h hold) Push(line *gcode.Line, emit Emit) error {
+	return h.Add(line)
+}
+
+func (h hold) Flush(emit Emit) error {
+	h.Settle()
+	return h.Emit(emit)
+}
+
+func TestRunChain(t *testing.T) {
+	input := "; header\r\nG1 X0 Y0 F1800\r\nG1 X10.5 E1 ; keep\r\nM117  a  b \r\nT0\r\nG1 X20 E1"
+	tests := []struct {
+		name  string
+		procs []Processor
+		want  string
+	}{
+		{
+			name:  "pass",
+			procs: []Processor{hold{timeline.NewTimeline(nil, nil, nil, 0, nil)}},
+			want:  input,
+		},
+		{
+			name:  "hold then scale",
+			procs: []Processor{hold{timeline.NewTimeline(nil, nil, nil, 0, nil)}, scale(0.5)},
+			want:  "; header\r\nG1 X0 Y0 F1800\r\nG1 X10.5 E0.5 ; keep\r\nM117  a  b \r\nT0\r\nG1 X20 E0.5",
+		},
+		{
+			name:  "scale then hold",
+			procs: []Processor{scale(0.5), hold{timeline.NewTimeline(nil, nil, nil, 0, nil)}, scale(3)},
+			want:  "; header\r\nG1 X0 Y0 F1800\r\nG1 X10.5 E1.5 ; keep\r\nM117  a  b \r\nT0\r\nG1 X20 E1.5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			if err := Run(strings.NewReader(input), &b, New(tt.procs...), nil); err != nil {
+				t.Fatalf("failed to run: %v", err)
+			}
+			if b.String() != tt.want {
+				t.Errorf("output %q, want %q", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunPrecision(t *testing.T) {
+	input := "G1 X10.123456789 E1\r\nG1 X20 E0.5\r\n"
+	tests := []struct {
+		precision *int
+		want      string
+	}{
+		{want: "G1 X10.123456789 E0.33333\r\nG1 X20 E0.16667\r\n"},
+		{precision: intPtr(2), want: "G1 X10.123456789 E0.33\r\nG1 X20 E0.17\r\n"},
+		{precision: intPtr(-1), want: "G1 X10.123456789 E0.3333333333333333\r\nG1 X20 E0.16666666666666666\r\n"},
+	}
+	for _, tt := range tests {
+		var opts *Options
+		if tt.precision != nil {
+			opts = &Options{Precision: tt.precision}
+		}
+		var b bytes.Buffer
+		if err := Run(strings.NewReader(input), &b, New(scale(1.0/3)), opts); err != nil {
+			t.Fatalf("failed to run: %v", err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("precision %v: output %q, want %q", tt.precision, b.String(), tt.want)
+		}
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
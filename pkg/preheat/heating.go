@@ -0,0 +1,153 @@
+package preheat
+
+import (
+	"fmt"
+	"math"
+)
+
+// HeatingConfig limits the heaters heating at full power at the same time,
+// e.g. the PSU can not power all of them.
+type HeatingConfig struct {
+	MaxConcurrent int     `yaml:"max_concurrent"` // heaters heating at once, 0 for no limit
+	PowerBudget   float64 `yaml:"power_budget"`   // W, total power of the heaters heating at once, 0 for no limit
+}
+
+func (c *HeatingConfig) Validate(extruders []*Extruder) error {
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("max concurrent heating cannot be negative")
+	}
+	if c.PowerBudget < 0 {
+		return fmt.Errorf("heating power budget cannot be negative")
+	}
+	if c.PowerBudget > 0 {
+		for _, extruder := range extruders {
+			if extruder.HeaterPower <= 0 {
+				return fmt.Errorf("extruder %s: heater power must be positive with a power budget", extruder.Name)
+			}
+			if extruder.HeaterPower > c.PowerBudget {
+				return fmt.Errorf("extruder %s: heater power is over the power budget", extruder.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// heating is a heater at full power during [start, end)
+type heating struct {
+	start, end float64
+	power      float64
+}
+
+// fits checks the heating along with the scheduled ones is within the limits
+func (c *HeatingConfig) fits(h heating, scheduled []heating) bool {
+	// the load only increases at the start of a heating
+	points := []float64{h.start}
+	for _, o := range scheduled {
+		if o.start > h.start && o.start < h.end {
+			points = append(points, o.start)
+		}
+	}
+	for _, t := range points {
+		count, power := 1, h.power
+		for _, o := range scheduled {
+			if o.start <= t && t < o.end {
+				count++
+				power += o.power
+			}
+		}
+		if c.MaxConcurrent > 0 && count > c.MaxConcurrent {
+			return false
+		}
+		if c.PowerBudget > 0 && power > c.PowerBudget+1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+// scheduleHeating shifts the preheats so the heaters heating at once are
+// within the limits. A preheat is moved earlier, which grows its lead time,
+// or later if it can not be, which leaves a wait at the toolchange.
+func (s *State) scheduleHeating(first int) {
+	cfg := s.Config.Heating
+	if cfg == nil || (cfg.MaxConcurrent == 0 && cfg.PowerBudget == 0) {
+		return
+	}
+
+	// the earliest line to preheat each toolchange, after the extruder is parked
+	lower := make(map[*Toolchange]int)
+	parked := make(map[*Extruder]int)
+	var preheats []*Toolchange
+	for _, tc := range s.Toolchanges {
+		if tc.PreheatIndex >= 0 {
+			lower[tc] = first
+			if index, ok := parked[tc.Extruder]; ok && index > first {
+				lower[tc] = index
+			}
+			preheats = append(preheats, tc)
+		}
+		if tc.Prev != nil {
+			parked[tc.Prev] = tc.Index + 2
+		}
+	}
+
+	var scheduled []heating
+	for _, tc := range preheats {
+		start := s.Lines[tc.PreheatIndex].PrintTime
+		h := heating{start: start, end: start + tc.LeadTime, power: tc.Extruder.HeaterPower}
+		if cfg.fits(h, scheduled) {
+			scheduled = append(scheduled, h)
+			continue
+		}
+
+		// candidates: right before or after each scheduled heating
+		earliest := s.Lines[lower[tc]].PrintTime
+		latest := s.Lines[tc.Index].PrintTime
+		best, shift := math.NaN(), math.Inf(1)
+		try := func(t float64) {
+			if t < earliest || t > latest {
+				return
+			}
+			c := heating{start: t, end: t + tc.LeadTime, power: h.power}
+			if !cfg.fits(c, scheduled) {
+				return
+			}
+			// earlier is preferred, it doesn't cost a wait
+			d := math.Abs(t - start)
+			if t > start {
+				d += latest
+			}
+			if d < shift {
+				best, shift = t, d
+			}
+		}
+		for _, o := range scheduled {
+			try(o.start - tc.LeadTime)
+			try(o.end)
+		}
+		try(earliest)
+
+		if math.IsNaN(best) {
+			s.Log.Warnf("no room to preheat %s for the toolchange at line %d within the heating limits", tc.Extruder.Name, tc.Index+1)
+			scheduled = append(scheduled, h)
+			continue
+		}
+
+		// the time is between lines, try the line before first for the lead time
+		index := s.LineAt(best)
+		if index > tc.Index {
+			index = tc.Index
+		}
+		if index > lower[tc] && s.Lines[index].PrintTime > best {
+			t := s.Lines[index-1].PrintTime
+			if cfg.fits(heating{start: t, end: t + tc.LeadTime, power: h.power}, scheduled) {
+				index--
+			}
+		}
+		t := s.Lines[index].PrintTime
+		tc.HeatingShift = start - t
+		tc.PreheatIndex = index
+		scheduled = append(scheduled, heating{start: t, end: t + tc.LeadTime, power: h.power})
+		s.Log.Warnf("preheat of %s for the toolchange at line %d is shifted by %.1fs for the heating limits", tc.Extruder.Name, tc.Index+1, tc.HeatingShift)
+	}
+}
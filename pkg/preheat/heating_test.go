@@ -0,0 +1,53 @@
+package preheat
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScheduleHeating(t *testing.T) {
+	// the preheats of T1 and T2 overlap, T2 could be preheated earlier
+	input := toolFile("T0", 20, "T1", 2, "T2", 10)
+
+	tests := []struct {
+		heating *HeatingConfig
+		power   float64
+		shifted bool
+	}{
+		{heating: nil},
+		{heating: &HeatingConfig{MaxConcurrent: 2}},
+		{heating: &HeatingConfig{MaxConcurrent: 1}, shifted: true},
+		{heating: &HeatingConfig{PowerBudget: 80}, power: 40},
+		{heating: &HeatingConfig{PowerBudget: 60}, power: 40, shifted: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%+v", tt.heating), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Heating = tt.heating
+			cfg.Defaults.HeaterPower = tt.power
+			state, _ := runPreheat(t, cfg, input)
+
+			var heatings []heating
+			for _, tc := range state.Toolchanges[1:] {
+				if tc.PreheatIndex < 0 {
+					t.Fatalf("toolchange at line %d is not preheated", tc.Index+1)
+				}
+				if tc.Wait != 0 {
+					t.Errorf("toolchange at line %d waits %.2fs", tc.Index+1, tc.Wait)
+				}
+				start := state.Lines[tc.PreheatIndex].PrintTime
+				heatings = append(heatings, heating{start: start, end: start + tc.LeadTime})
+			}
+
+			t2 := state.Toolchanges[2]
+			if shifted := t2.HeatingShift > 0; shifted != tt.shifted {
+				t.Errorf("preheat of T2 is shifted by %.2fs, want shifted %v", t2.HeatingShift, tt.shifted)
+			}
+			a, b := heatings[0], heatings[1]
+			if overlap := a.start < b.end && b.start < a.end; overlap == tt.shifted {
+				t.Errorf("preheats [%.2f, %.2f) and [%.2f, %.2f) overlap %v, want %v",
+					a.start, a.end, b.start, b.end, overlap, !tt.shifted)
+			}
+		})
+	}
+}
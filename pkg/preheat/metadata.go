@@ -0,0 +1,136 @@
+package preheat
+
+import (
+	"strconv"
+	"strings"
+)
+
+// SlicerMetadata is the per-tool temperatures written by the slicer, keyed
+// by the tool index:
+//
+//	; temperature = 215,240                     # PrusaSlicer/SuperSlicer
+//	; first_layer_temperature = 220,245
+//	; idle_temperature = 150,nil
+//	; standby_temperature_delta = -5
+//	; nozzle_temperature = 215,240              # OrcaSlicer/BambuStudio
+//	; nozzle_temperature_initial_layer = 220,245
+//	;EXTRUDER_TRAIN.1.INITIAL_TEMPERATURE:240   # Cura
+//	M104 T1 S240                                # start gcode
+type SlicerMetadata struct {
+	FirstLayer map[int]float64 // first layer temperature
+	Print      map[int]float64 // temperature of the other layers
+	Standby    map[int]float64 // temperature when the tool is idle
+	Initial    map[int]float64 // initial temperature in the header or the start gcode
+
+	standbyDelta *float64 // standby temperature relative to the print temperature
+}
+
+func NewSlicerMetadata() *SlicerMetadata {
+	return &SlicerMetadata{
+		FirstLayer: make(map[int]float64),
+		Print:      make(map[int]float64),
+		Standby:    make(map[int]float64),
+		Initial:    make(map[int]float64),
+	}
+}
+
+// Feed reads the temperatures from a comment of the gcode file
+func (m *SlicerMetadata) Feed(comment string) {
+	comment = strings.TrimSpace(comment)
+
+	// cura header: EXTRUDER_TRAIN.<index>.INITIAL_TEMPERATURE:<temp>
+	if rest, ok := strings.CutPrefix(comment, "EXTRUDER_TRAIN."); ok {
+		key, value, ok := strings.Cut(rest, ":")
+		if !ok {
+			return
+		}
+		index, name, ok := strings.Cut(key, ".")
+		if !ok || name != "INITIAL_TEMPERATURE" {
+			return
+		}
+		i, err := strconv.Atoi(index)
+		if err != nil {
+			return
+		}
+		if temp, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && temp > 0 {
+			m.Initial[i] = temp
+		}
+		return
+	}
+
+	// prusaslicer/orcaslicer config: <key> = <values>
+	key, value, ok := strings.Cut(comment, "=")
+	if !ok {
+		return
+	}
+	switch strings.TrimSpace(key) {
+	case "temperature", "nozzle_temperature":
+		parseTemperatures(value, m.Print)
+	case "first_layer_temperature", "nozzle_temperature_initial_layer":
+		parseTemperatures(value, m.FirstLayer)
+	case "idle_temperature":
+		parseTemperatures(value, m.Standby)
+	case "standby_temperature_delta":
+		if delta, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			m.standbyDelta = &delta
+		}
+	}
+}
+
+// parseTemperatures parses a list of temperatures of each tool, the invalid
+// ones (e.g. nil) are skipped.
+func parseTemperatures(value string, temps map[int]float64) {
+	for i, v := range strings.Split(value, ",") {
+		if temp, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil && temp > 0 {
+			temps[i] = temp
+		}
+	}
+}
+
+// SetInitial records the temperature set by the start gcode, the header
+// takes precedence.
+func (m *SlicerMetadata) SetInitial(index int, temp float64) {
+	if _, ok := m.Initial[index]; !ok {
+		m.Initial[index] = temp
+	}
+}
+
+func (m *SlicerMetadata) FirstLayerTemp(index int) float64 {
+	if temp, ok := m.FirstLayer[index]; ok {
+		return temp
+	}
+	if temp, ok := m.Initial[index]; ok {
+		return temp
+	}
+	return m.Print[index]
+}
+
+func (m *SlicerMetadata) PrintTemp(index int) float64 {
+	if temp, ok := m.Print[index]; ok {
+		return temp
+	}
+	if temp, ok := m.FirstLayer[index]; ok {
+		return temp
+	}
+	return m.Initial[index]
+}
+
+func (m *SlicerMetadata) StandbyTemp(index int) float64 {
+	if temp, ok := m.Standby[index]; ok {
+		return temp
+	}
+	if m.standbyDelta != nil {
+		if temp := m.PrintTemp(index); temp > 0 {
+			return temp + *m.standbyDelta
+		}
+	}
+	return 0
+}
+
+// Temp returns the print temperature of the tool at the layer
+func (m *SlicerMetadata) Temp(index, layer int) float64 {
+	if layer <= 1 {
+		return m.FirstLayerTemp(index)
+	}
+	return m.PrintTemp(index)
+}
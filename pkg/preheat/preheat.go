@@ -0,0 +1,637 @@
+package preheat
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+	"github.com/alexjx/gcodeproc/pkg/pipeline"
+	"github.com/alexjx/gcodeproc/pkg/timeline"
+	"github.com/sirupsen/logrus"
+)
+
+// IdleAction is what to do with an extruder after it's parked
+type IdleAction int
+
+const (
+	IdleKeep    IdleAction = iota // kept hot
+	IdleStandby                   // standby temperature
+	IdleOff                       // turned off
+)
+
+func (a IdleAction) String() string {
+	switch a {
+	case IdleStandby:
+		return "standby"
+	case IdleOff:
+		return "off"
+	}
+	return "keep"
+}
+
+type Extruder struct {
+	Name            string        `yaml:"name"`
+	Index           *int          `yaml:"index"` // tool index, the number in the name if not set
+	HeatUp          float64       `yaml:"heat_up"`
+	ActiveGcode     string        `yaml:"active_gcode"`
+	DeactivateGcode string        `yaml:"deactivate_gcode"` // same as standby_gcode
+	Thermal         *ThermalModel `yaml:"thermal"`
+
+	// rules to identify the toolchange, matches the name as opcode if empty
+	Match []*timeline.ToolchangeMatch `yaml:"match"`
+
+	// idle policy, decided by the idle time until the extruder is used again
+	MinIdleForStandby float64 `yaml:"min_idle_for_standby"`
+	StandbyGcode      string  `yaml:"standby_gcode"`
+	MinIdleForOff     float64 `yaml:"min_idle_for_off"`
+	OffGcode          string  `yaml:"off_gcode"`
+
+	// inserted after the extruder is parked for the last time
+	FinalOffGcode string `yaml:"final_off_gcode"`
+
+	// inserted before the toolchange if the extruder could not be fully preheated
+	WaitGcode string `yaml:"wait_gcode"`
+
+	// W, power of the heater, for the heating power budget
+	HeaterPower float64 `yaml:"heater_power"`
+
+	// set by Validate, the config is read-only after it
+	index     int
+	templates extruderTemplates
+}
+
+// IdleAction decides what to do with the extruder idle for the duration.
+func (e *Extruder) IdleAction(idle float64) IdleAction {
+	if e.OffGcode != "" && idle >= e.MinIdleForOff {
+		return IdleOff
+	}
+	if e.StandbyGcode != "" && idle >= e.MinIdleForStandby {
+		return IdleStandby
+	}
+	return IdleKeep
+}
+
+// LeadTime returns the time to preheat before a toolchange. idle is the time
+// since the extruder is deactivated by the action, negative if it's not used
+// before.
+func (e *Extruder) LeadTime(idle float64, action IdleAction) float64 {
+	if e.Thermal == nil {
+		return e.HeatUp
+	}
+	if idle < 0 {
+		return e.Thermal.HeatTime(e.Thermal.Ambient)
+	}
+	target := e.Thermal.Ambient
+	if action == IdleStandby {
+		target = math.Max(e.Thermal.Standby, target)
+	}
+	return e.Thermal.LeadTime(idle, target)
+}
+
+// temperature policies for the M104/M109 in the gcode file
+const (
+	TemperatureKeep     = "keep"      // keep all of them
+	TemperatureDrop     = "drop"      // drop all of them
+	TemperatureDropTool = "drop_tool" // drop the ones targeting a tool, e.g. M104 T1 S200
+	TemperatureRewrite  = "rewrite"   // rewrite into active/deactivate gcode of the tool
+)
+
+// Config is the preheat config. It's read-only after Validate, so it could be
+// shared by concurrent runs, the state of a run is kept in State.
+type Config struct {
+	Defaults          *Extruder                  `yaml:"defaults"` // default settings of the extruders
+	Extruders         []*Extruder                `yaml:"extruders"`
+	Costs             *timeline.GcodeCost        `yaml:"costs"`
+	Kinematics        *timeline.KinematicsConfig `yaml:"kinematics"`
+	TemperaturePolicy string                     `yaml:"temperature_policy"`
+	Insertion         *timeline.InsertionConfig  `yaml:"insertion"`
+	Heating           *HeatingConfig             `yaml:"heating"`
+}
+
+// Validate checks the config, and fills the defaults
+func (cfg *Config) Validate() error {
+	if len(cfg.Extruders) == 0 {
+		return fmt.Errorf("no extruders defined")
+	}
+	for i, extruder := range cfg.Extruders {
+		if extruder.Name == "" {
+			return fmt.Errorf("extruder name cannot be empty")
+		}
+		extruder.applyDefaults(cfg.Defaults)
+		extruder.index = extruder.resolveIndex(i)
+		if extruder.ActiveGcode == "" {
+			return fmt.Errorf("extruder active gcode cannot be empty")
+		}
+		if len(extruder.Match) == 0 {
+			extruder.Match = []*timeline.ToolchangeMatch{{Op: extruder.Name}}
+		}
+		for _, m := range extruder.Match {
+			if err := m.Compile(); err != nil {
+				return fmt.Errorf("extruder %s: %w", extruder.Name, err)
+			}
+		}
+		if extruder.StandbyGcode == "" {
+			extruder.StandbyGcode = extruder.DeactivateGcode
+		}
+		if err := extruder.compileTemplates(); err != nil {
+			return fmt.Errorf("extruder %s: %w", extruder.Name, err)
+		}
+		if extruder.Thermal != nil {
+			if err := extruder.Thermal.Validate(); err != nil {
+				return fmt.Errorf("extruder %s: %w", extruder.Name, err)
+			}
+		} else if extruder.HeatUp <= 0 {
+			return fmt.Errorf("extruder heat up time must be positive")
+		}
+	}
+	switch cfg.TemperaturePolicy {
+	case "":
+		cfg.TemperaturePolicy = TemperatureKeep
+	case TemperatureKeep, TemperatureDrop, TemperatureDropTool, TemperatureRewrite:
+	default:
+		return fmt.Errorf("unknown temperature policy: %s", cfg.TemperaturePolicy)
+	}
+	if cfg.Insertion != nil {
+		if err := cfg.Insertion.Validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.Heating != nil {
+		if err := cfg.Heating.Validate(cfg.Extruders); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Toolchange is a toolchange in the gcode file, with the preheat decisions
+type Toolchange struct {
+	Index    int // index of the toolchange line
+	Extruder *Extruder
+	Prev     *Extruder
+
+	LeadTime     float64    // time needed to preheat the extruder
+	PreheatIndex int        // index of the line to insert the preheat before, -1 for no preheat
+	Idle         IdleAction // what to do with the previous extruder after this toolchange
+	FinalOff     bool       // the previous extruder is not used any more
+	KeptHot      bool       // the deactivation is cancelled, the preheat would happen before it
+	IdleTime     float64    // time until the previous extruder is used again, -1 if never
+	Wait         float64    // residual time to wait for the extruder to heat up
+	HeatingShift float64    // time the preheat is moved earlier for the heating limits, negative if later
+
+	Temp  float64 // target temperature of the extruder from the gcode file
+	Layer int     // layer number of the toolchange
+}
+
+type State struct {
+	*timeline.Timeline
+
+	Config *Config
+
+	// state tracking
+	Current *Extruder
+
+	// gcode tracking
+	Toolchanges []*Toolchange
+	Temps       map[*Extruder]float64 // last target temperature of each extruder
+	Metadata    *SlicerMetadata
+	rewrites    []*rewrite
+	pendingTemp map[*Extruder]*Toolchange // toolchanges waiting for the temperature set after them
+	preheated   map[*Extruder]float64     // time when each extruder is preheated, -1 if not yet
+	deactivated map[*Extruder]float64     // time when each extruder is deactivated, -1 if not yet
+
+	DroppedTemperatures int64
+	ShortPreheats       int64 // toolchanges not fully preheated
+}
+
+// MatchToolchange returns the extruder selected by the gcode, nil if it's not
+// a toolchange.
+func (s *State) MatchToolchange(g *timeline.Gcode) *Extruder {
+	for _, extruder := range s.Config.Extruders {
+		for _, m := range extruder.Match {
+			if m.Match(g) {
+				return extruder
+			}
+		}
+	}
+	return nil
+}
+
+// TemperatureExtruder returns the extruder targeted by a M104/M109 gcode,
+// which is the T param or the current extruder.
+func (s *State) TemperatureExtruder(g *timeline.Gcode) *Extruder {
+	if g.T.Valid {
+		for _, extruder := range s.Config.Extruders {
+			if extruder.index == int(g.T.Value) {
+				return extruder
+			}
+		}
+		return nil
+	}
+	return s.Current
+}
+
+// ApplyTemperaturePolicy returns the line to output for a M104/M109 gcode.
+// The dropped ones are left as comments and reported.
+func (s *State) ApplyTemperaturePolicy(g *timeline.Gcode) string {
+	drop := func() string {
+		s.DroppedTemperatures++
+		if g.S.Valid && g.S.Value == 0 {
+			s.Log.Warnf("dropped heater off gcode at line %d: %s", g.LineNo, g.Line)
+		} else {
+			s.Log.Warnf("dropped temperature gcode at line %d: %s", g.LineNo, g.Line)
+		}
+		return "; dropped by preheat: " + g.Line
+	}
+
+	switch s.Config.TemperaturePolicy {
+	case TemperatureDrop:
+		return drop()
+	case TemperatureDropTool:
+		if g.T.Valid {
+			return drop()
+		}
+	case TemperatureRewrite:
+		if g.Op == "M109" {
+			// the active gcode does not wait, keep the wait of the slicer
+			return g.Line
+		}
+		extruder := s.TemperatureExtruder(g)
+		if extruder == nil {
+			s.Log.Warnf("no extruder for temperature gcode at line %d: %s", g.LineNo, g.Line)
+			return g.Line
+		}
+		tmpl := extruder.templates.active
+		if g.S.Valid && g.S.Value == 0 {
+			// the heater must stay off, never rewritten into standby
+			tmpl = extruder.templates.off
+			if tmpl == nil {
+				tmpl = extruder.templates.final
+			}
+		}
+		if tmpl == nil {
+			return g.Line
+		}
+		// rendered after the scan, when the print time and the metadata are known
+		ctx := TemplateContext{
+			Tool:      extruder.Name,
+			ToolIndex: extruder.index,
+			PrevIndex: -1,
+			Temp:      g.S.Value,
+			Layer:     s.Layer,
+		}
+		if s.Current != nil {
+			ctx.Tool, ctx.ToolIndex = s.Current.Name, s.Current.index
+		}
+		s.rewrites = append(s.rewrites, &rewrite{
+			index:    int(g.LineNo - 1),
+			extruder: extruder,
+			tmpl:     tmpl,
+			ctx:      ctx,
+		})
+	}
+	return g.Line
+}
+
+// Options are the settings of a run, besides the config
+type Options struct {
+	SpeedChangeRatio float64            // rough estimation with the ratio of speed change phase if positive, instead of kinematics
+	Debug            bool               // appends the time of the moves and the toolchanges as comments
+	Logger           logrus.FieldLogger // nothing is logged if nil
+	Precision        *int               // decimal places of the edited numbers, gcode.DefaultPrecision if nil
+}
+
+// output returns the settings of the output, nil if the options are nil
+func (o *Options) output() *pipeline.Options {
+	if o == nil {
+		return nil
+	}
+	return &pipeline.Options{Precision: o.Precision}
+}
+
+// Result is the outcome of the preheat
+type Result struct {
+	Report              *Report
+	Simulation          *Simulation
+	DroppedTemperatures int64
+	ShortPreheats       int64 // toolchanges not fully preheated
+}
+
+// Preheat reads the gcode, and writes it with the preheat gcodes inserted.
+// The config must be validated.
+func Preheat(r io.Reader, w io.Writer, cfg *Config, opts *Options) (*Result, error) {
+	p := NewProcessor(cfg, opts)
+	if err := pipeline.Run(r, w, p, opts.output()); err != nil {
+		return nil, err
+	}
+	return p.Result(), nil
+}
+
+// Processor is the preheat in a pipeline. The whole file is needed to plan,
+// so the lines are emitted when it's flushed.
+type Processor struct {
+	State *State
+
+	debug bool
+}
+
+// NewProcessor creates the processor of a validated config
+func NewProcessor(cfg *Config, opts *Options) *Processor {
+	if opts == nil {
+		opts = &Options{}
+	}
+	tl := timeline.NewTimeline(cfg.Costs, cfg.Kinematics, cfg.Insertion, opts.SpeedChangeRatio, opts.Logger)
+	return &Processor{State: NewState(cfg, tl), debug: opts.Debug}
+}
+
+// Push tracks the time of each line, the first pass
+func (p *Processor) Push(line *gcode.Line, emit pipeline.Emit) error {
+	return p.State.Add(line, p.State)
+}
+
+// Flush decides and inserts the preheat gcodes, the second pass, and emits
+// all the lines.
+func (p *Processor) Flush(emit pipeline.Emit) error {
+	state := p.State
+	state.Settle()
+	if err := state.Plan(); err != nil {
+		return err
+	}
+
+	if p.debug {
+		state.DebugComments()
+	}
+	if err := state.Emit(emit); err != nil {
+		return err
+	}
+
+	if state.DroppedTemperatures > 0 {
+		state.Log.Warnf("dropped %d temperature gcodes, check the heaters are turned off at the end", state.DroppedTemperatures)
+	}
+	return nil
+}
+
+// Result returns the outcome after the processor is flushed
+func (p *Processor) Result() *Result {
+	return p.State.Result()
+}
+
+// Result collects the outcome of the plan
+func (s *State) Result() *Result {
+	return &Result{
+		Report:              s.Report(),
+		Simulation:          s.Simulate(),
+		DroppedTemperatures: s.DroppedTemperatures,
+		ShortPreheats:       s.ShortPreheats,
+	}
+}
+
+// NewState creates the preheat scheduler on the timeline
+func NewState(cfg *Config, tl *timeline.Timeline) *State {
+	state := &State{
+		Timeline:    tl,
+		Config:      cfg,
+		Temps:       make(map[*Extruder]float64),
+		Metadata:    NewSlicerMetadata(),
+		pendingTemp: make(map[*Extruder]*Toolchange),
+		preheated:   make(map[*Extruder]float64),
+		deactivated: make(map[*Extruder]float64),
+	}
+	for _, extruder := range cfg.Extruders {
+		state.preheated[extruder] = -1.0
+		state.deactivated[extruder] = -1.0
+	}
+	return state
+}
+
+// Visit tracks the temperatures and finds the toolchanges.
+func (s *State) Visit(g *timeline.Gcode) error {
+	if g.Comment != "" {
+		s.Metadata.Feed(g.Comment)
+	}
+
+	if g.Parsed && (g.Op == "M104" || g.Op == "M109") {
+		if s.Layer == 0 && g.T.Valid && g.S.Valid && g.S.Value > 0 {
+			// set by the start gcode
+			s.Metadata.SetInitial(int(g.T.Value), g.S.Value)
+		}
+		if extruder := s.TemperatureExtruder(g); extruder != nil && g.S.Valid && g.S.Value > 0 {
+			s.Temps[extruder] = g.S.Value
+			if tc := s.pendingTemp[extruder]; tc != nil {
+				tc.Temp = g.S.Value
+				delete(s.pendingTemp, extruder)
+			}
+		}
+
+		// the temperature changes from slicer might conflict with preheat
+		g.Line = s.ApplyTemperaturePolicy(g)
+	}
+
+	toolchange := s.MatchToolchange(g)
+	if toolchange == nil {
+		return nil
+	}
+	g.ToolchangeCode = true
+	if s.Config.Costs != nil {
+		g.Time = s.Config.Costs.Toolchange
+	}
+
+	tc := &Toolchange{
+		Index:        int(g.LineNo - 1),
+		Extruder:     toolchange,
+		Prev:         s.Current,
+		PreheatIndex: -1,
+		Temp:         s.Temps[toolchange],
+		Layer:        s.Layer,
+	}
+	s.Toolchanges = append(s.Toolchanges, tc)
+	s.pendingTemp[toolchange] = tc
+	s.Current = toolchange
+	return nil
+}
+
+// Plan decides where to preheat the extruder of each toolchange and what to
+// do with the previous one until it's used again.
+//
+// Each extruder is preheated its lead time before the toolchange. If the
+// preheat would happen before the extruder is parked, the extruder is kept
+// hot instead:
+//
+//	----pA-pB---pA--a-b-a
+//	                  ^ if we deactivated a here, the preheat pA is useless
+func (s *State) Plan() error {
+	if err := s.renderRewrites(); err != nil {
+		return err
+	}
+	if len(s.Toolchanges) == 0 {
+		return nil
+	}
+
+	// next use of the previous extruder of each toolchange
+	next := make([]*Toolchange, len(s.Toolchanges))
+	upcoming := make(map[*Extruder]*Toolchange)
+	for i := len(s.Toolchanges) - 1; i >= 0; i-- {
+		tc := s.Toolchanges[i]
+		if tc.Prev != nil {
+			next[i] = upcoming[tc.Prev]
+		}
+		upcoming[tc.Extruder] = tc
+	}
+
+	// do not preheat before the first toolchange, the start gcode heats the tools
+	first := s.Toolchanges[0].Index + 1
+	preheatIndex := func(tc *Toolchange) int {
+		// the line started by the time, so the preheat gets the full lead time
+		index := s.LineBefore(s.Lines[tc.Index].PrintTime - tc.LeadTime)
+		if index < first {
+			index = first
+		}
+		return s.Snap(index, first, tc.Index)
+	}
+
+	used := make(map[*Extruder]bool)
+	used[s.Toolchanges[0].Extruder] = true
+	for i, tc := range s.Toolchanges {
+		if i == 0 || tc.Extruder == tc.Prev {
+			continue
+		}
+		printTime := s.Lines[tc.Index].PrintTime
+
+		// the first use of an extruder is preheated from cold
+		if !used[tc.Extruder] {
+			used[tc.Extruder] = true
+			tc.LeadTime = tc.Extruder.LeadTime(-1, IdleOff)
+			tc.PreheatIndex = preheatIndex(tc)
+		}
+
+		// decide by the idle time until the previous extruder is used again
+		idle := math.Inf(1)
+		tc.IdleTime = -1
+		n := next[i]
+		if n != nil {
+			idle = s.Lines[n.Index].PrintTime - printTime
+			tc.IdleTime = idle
+		} else if tc.Prev.FinalOffGcode != "" {
+			// this is the last use of the previous extruder
+			tc.Idle = IdleOff
+			tc.FinalOff = true
+			continue
+		}
+		tc.Idle = tc.Prev.IdleAction(idle)
+		if n == nil || tc.Idle == IdleKeep {
+			continue
+		}
+
+		n.LeadTime = n.Extruder.LeadTime(idle, tc.Idle)
+		if index := preheatIndex(n); index > tc.Index+1 {
+			n.PreheatIndex = index
+		} else {
+			// still hot since it was parked
+			s.Log.Debugf("keep %s hot from %.1f to %.1f", tc.Prev.Name, printTime, printTime+idle)
+			tc.Idle = IdleKeep
+			tc.KeptHot = true
+		}
+	}
+
+	s.scheduleHeating(first)
+	s.residualWaits()
+
+	// generate the gcodes to insert, in order
+	for _, tc := range s.Toolchanges[1:] {
+		printTime := s.Lines[tc.Index].PrintTime
+		ctx := s.toolchangeContext(tc)
+		s.Log.Debugf("toolchange %s -> %s @ %.1f", tc.Prev.Name, tc.Extruder.Name, printTime)
+
+		if tc.PreheatIndex >= 0 {
+			extruder := tc.Extruder
+			preheatTime := s.Lines[tc.PreheatIndex].PrintTime
+			code, err := s.render(extruder, extruder.templates.active, ctx)
+			if err != nil {
+				return fmt.Errorf("failed to render active gcode of %s: %w", extruder.Name, err)
+			}
+			s.Log.Debugf("preheat %s @ %.1f for %.1f, lead %.1f", extruder.Name, preheatTime, printTime, tc.LeadTime)
+			s.Insert(tc.PreheatIndex,
+				fmt.Sprintf("; PREHEAT %s [%.1f -> %.1f] (last %.1f / deactive %.1f) \n%s",
+					extruder.Name, preheatTime, printTime,
+					s.preheated[extruder], s.deactivated[extruder],
+					code,
+				))
+			s.preheated[extruder] = preheatTime
+		}
+
+		if tc.Wait > 0 {
+			extruder := tc.Extruder
+			s.ShortPreheats++
+			s.Log.Warnf("%s is not fully preheated for the toolchange at line %d, %.1fs short", extruder.Name, tc.Index+1, tc.Wait)
+			if extruder.templates.wait != nil {
+				ctx.Wait = tc.Wait
+				code, err := s.render(extruder, extruder.templates.wait, ctx)
+				if err != nil {
+					return fmt.Errorf("failed to render wait gcode of %s: %w", extruder.Name, err)
+				}
+				s.Insert(tc.Index,
+					fmt.Sprintf("; WAIT %s @ %.1f (%.1f short)\n%s", extruder.Name, printTime, tc.Wait, code))
+			}
+		}
+
+		// the previous extruder is rendered with its last known temperature
+		ctx.Temp = s.Temps[tc.Prev]
+		if tc.FinalOff {
+			extruder := tc.Prev
+			code, err := s.render(extruder, extruder.templates.final, ctx)
+			if err != nil {
+				return fmt.Errorf("failed to render final off gcode of %s: %w", extruder.Name, err)
+			}
+			s.Log.Debugf("final off %s @ %.1f", extruder.Name, printTime)
+			s.Insert(tc.Index+1,
+				fmt.Sprintf("; FINAL OFF %s @ %.1f\n%s", extruder.Name, printTime, code))
+			s.deactivated[extruder] = printTime
+		} else if tc.Idle != IdleKeep {
+			extruder := tc.Prev
+			tmpl := extruder.templates.standby
+			if tc.Idle == IdleOff {
+				tmpl = extruder.templates.off
+			}
+			code, err := s.render(extruder, tmpl, ctx)
+			if err != nil {
+				return fmt.Errorf("failed to render %s gcode of %s: %w", tc.Idle, extruder.Name, err)
+			}
+			s.Log.Debugf("deactivate %s @ %.1f (%s)", extruder.Name, printTime, tc.Idle)
+			s.Insert(tc.Index+1,
+				fmt.Sprintf("; DEACTIVATE %s @ %.1f (%s)\n%s", extruder.Name, printTime, tc.Idle, code))
+			s.deactivated[extruder] = printTime
+		}
+	}
+
+	if s.ShortPreheats > 0 {
+		s.Insert(len(s.Lines),
+			fmt.Sprintf("; preheat: %d toolchanges are not fully preheated", s.ShortPreheats))
+	}
+	return nil
+}
+
+// DebugComments adds the time of the moves and the toolchanges to the output
+func (s *State) DebugComments() {
+	toolchanges := make(map[int]*Toolchange)
+	for _, tc := range s.Toolchanges {
+		toolchanges[tc.Index] = tc
+	}
+
+	for i, line := range s.Lines {
+		var debugComment string
+		tc, isToolchange := toolchanges[i]
+		if line.Move || isToolchange {
+			debugComment = fmt.Sprintf("  ; printTime=%.1f", line.PrintTime)
+		}
+		if isToolchange && tc.Prev != nil {
+			debugComment += " prev=" + tc.Prev.Name
+			if tc.PreheatIndex >= 0 {
+				debugComment += fmt.Sprintf(" preheated [%.1f -> %.1f]", s.Lines[tc.PreheatIndex].PrintTime, line.PrintTime)
+			}
+		}
+		if debugComment != "" {
+			s.Comments[i] += debugComment
+		}
+	}
+}
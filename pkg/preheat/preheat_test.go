@@ -0,0 +1,128 @@
+package preheat
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/alexjx/gcodeproc/pkg/pipeline"
+)
+
+// toolFile generates a gcode file of the toolchanges, each followed by the
+// count of extruding moves of about 3.4s
+func toolFile(blocks ...any) string {
+	var b strings.Builder
+	b.WriteString("M83\nM104 T0 S200\nM104 T1 S210\nM104 T2 S220\nG1 X0 Y0 F1800\n")
+	for i := 0; i < len(blocks); i += 2 {
+		fmt.Fprintf(&b, "%s\n", blocks[i])
+		for j := 0; j < blocks[i+1].(int); j++ {
+			fmt.Fprintf(&b, "G1 X%d E5\n", 100*((j+1)%2))
+		}
+	}
+	return b.String()
+}
+
+func testConfig() *Config {
+	return &Config{
+		Defaults: &Extruder{
+			HeatUp:        20,
+			ActiveGcode:   "M104 T{{.Index}} S{{.Temp}}",
+			OffGcode:      "M104 T{{.Index}} S0",
+			MinIdleForOff: 10,
+			FinalOffGcode: "M104 T{{.Index}} S0",
+			WaitGcode:     "M116 P{{.Index}}",
+		},
+		Extruders: []*Extruder{{Name: "T0"}, {Name: "T1"}, {Name: "T2"}},
+	}
+}
+
+// runPreheat runs the preheat of the config over the gcode
+func runPreheat(t *testing.T, cfg *Config, input string) (*State, string) {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate: %v", err)
+	}
+	p := NewProcessor(cfg, nil)
+	var b bytes.Buffer
+	if err := pipeline.Run(strings.NewReader(input), &b, p, nil); err != nil {
+		t.Fatalf("failed to preheat: %v", err)
+	}
+	return p.State, b.String()
+}
+
+func TestPlan(t *testing.T) {
+	state, output := runPreheat(t, testConfig(), toolFile("T0", 10, "T1", 10, "T0", 5, "T1", 10, "T2", 5))
+
+	tests := []struct {
+		tool     string
+		preheat  bool
+		idle     IdleAction
+		finalOff bool
+		keptHot  bool
+	}{
+		{tool: "T0"},
+		// first use of T1, T0 is used again after 34s
+		{tool: "T1", preheat: true, idle: IdleOff},
+		// T1 is used again after 17s, shorter than its heat up
+		{tool: "T0", preheat: true, idle: IdleKeep, keptHot: true},
+		{tool: "T1", idle: IdleOff, finalOff: true},
+		{tool: "T2", preheat: true, idle: IdleOff, finalOff: true},
+	}
+	if len(state.Toolchanges) != len(tests) {
+		t.Fatalf("%d toolchanges, want %d", len(state.Toolchanges), len(tests))
+	}
+	for i, tt := range tests {
+		tc := state.Toolchanges[i]
+		if tc.Extruder.Name != tt.tool {
+			t.Errorf("toolchange %d: tool %s, want %s", i, tc.Extruder.Name, tt.tool)
+		}
+		if (tc.PreheatIndex >= 0) != tt.preheat || tc.Idle != tt.idle || tc.FinalOff != tt.finalOff || tc.KeptHot != tt.keptHot {
+			t.Errorf("toolchange %d: preheat %v idle %s final off %v kept hot %v, want %v %s %v %v",
+				i, tc.PreheatIndex >= 0, tc.Idle, tc.FinalOff, tc.KeptHot, tt.preheat, tt.idle, tt.finalOff, tt.keptHot)
+		}
+		if tc.Wait != 0 {
+			t.Errorf("toolchange %d: waits %.2fs", i, tc.Wait)
+		}
+	}
+
+	for marker, count := range map[string]int{
+		"; PREHEAT ":    3,
+		"; DEACTIVATE ": 1,
+		"; FINAL OFF ":  2,
+		"; WAIT ":       0,
+	} {
+		if n := strings.Count(output, marker); n != count {
+			t.Errorf("%d %q in the output, want %d", n, marker, count)
+		}
+	}
+	if !strings.Contains(output, "; PREHEAT T1 [") || !strings.Contains(output, "\nM104 T1 S210\n") {
+		t.Errorf("no preheat of T1 at its temperature in the output")
+	}
+}
+
+func TestPreheatLeadTime(t *testing.T) {
+	for _, heatUp := range []float64{5, 20, 21.7, 40} {
+		t.Run(fmt.Sprint(heatUp), func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Defaults.HeatUp = heatUp
+			cfg.Defaults.OffGcode = ""
+			state, _ := runPreheat(t, cfg, toolFile("T0", 20, "T1", 20, "T0", 20, "T1", 20))
+
+			preheats := 0
+			for _, tc := range state.Toolchanges {
+				if tc.PreheatIndex < 0 {
+					continue
+				}
+				preheats++
+				lead := state.Lines[tc.Index].PrintTime - state.Lines[tc.PreheatIndex].PrintTime
+				if lead < tc.LeadTime {
+					t.Errorf("toolchange at line %d is preheated %.2fs ahead, want %.2fs", tc.Index+1, lead, tc.LeadTime)
+				}
+			}
+			if preheats == 0 {
+				t.Errorf("nothing preheated")
+			}
+		})
+	}
+}
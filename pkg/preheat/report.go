@@ -0,0 +1,133 @@
+package preheat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// Report is the timeline of the preheat decisions
+type Report struct {
+	PrintTime   float64            `json:"print_time"`
+	Toolchanges []ToolchangeReport `json:"toolchanges"`
+	Tools       []ToolReport       `json:"tools"`
+}
+
+type InsertReport struct {
+	Line int     `json:"line"` // line number in the input file, inserted before it
+	Time float64 `json:"time"`
+}
+
+type ToolchangeReport struct {
+	Line     int           `json:"line"` // line number in the input file
+	Time     float64       `json:"time"`
+	Tool     string        `json:"tool"`
+	Prev     string        `json:"prev,omitempty"`
+	Layer    int           `json:"layer"`
+	LeadTime float64       `json:"lead_time"`
+	Preheat  *InsertReport `json:"preheat"` // null if not preheated
+
+	// what is done with the previous extruder: keep, standby, off or final_off
+	Deactivate string  `json:"deactivate,omitempty"`
+	KeptHot    bool    `json:"kept_hot"` // the deactivation is cancelled
+	Idle       float64 `json:"idle"`     // idle gap of the previous extruder, -1 if not used again
+	Wait       float64 `json:"wait"`     // residual wait for the extruder to heat up
+
+	// time the preheat is moved earlier for the heating limits, negative if later
+	HeatingShift float64 `json:"heating_shift"`
+}
+
+type ToolReport struct {
+	Name        string  `json:"name"`
+	Toolchanges int     `json:"toolchanges"`
+	IdleTime    float64 `json:"idle_time"`     // total time parked
+	HotIdleTime float64 `json:"hot_idle_time"` // total time parked while hot
+}
+
+// Report collects the decisions of the plan
+func (s *State) Report() *Report {
+	report := &Report{PrintTime: s.PrintTime}
+	tools := make(map[*Extruder]*ToolReport)
+	for _, extruder := range s.Config.Extruders {
+		tools[extruder] = &ToolReport{Name: extruder.Name}
+	}
+
+	for i, tc := range s.Toolchanges {
+		printTime := s.Lines[tc.Index].PrintTime
+		r := ToolchangeReport{
+			Line:     tc.Index + 1,
+			Time:     printTime,
+			Tool:     tc.Extruder.Name,
+			Layer:    tc.Layer,
+			LeadTime: tc.LeadTime,
+			Idle:     tc.IdleTime,
+			Wait:     tc.Wait,
+
+			HeatingShift: tc.HeatingShift,
+		}
+		tools[tc.Extruder].Toolchanges++
+
+		if tc.PreheatIndex >= 0 {
+			preheatTime := s.Lines[tc.PreheatIndex].PrintTime
+			r.Preheat = &InsertReport{Line: tc.PreheatIndex + 1, Time: preheatTime}
+			tools[tc.Extruder].HotIdleTime += printTime - preheatTime
+		}
+
+		if i > 0 && tc.Prev != nil && tc.Prev != tc.Extruder {
+			r.Prev = tc.Prev.Name
+			r.Deactivate = tc.Idle.String()
+			r.KeptHot = tc.KeptHot
+			if tc.FinalOff {
+				r.Deactivate = "final_off"
+			}
+
+			idle := tc.IdleTime
+			if idle < 0 {
+				idle = s.PrintTime - printTime
+			}
+			tools[tc.Prev].IdleTime += idle
+			if tc.Idle == IdleKeep && !tc.FinalOff {
+				tools[tc.Prev].HotIdleTime += idle
+			}
+		}
+
+		report.Toolchanges = append(report.Toolchanges, r)
+	}
+
+	for _, extruder := range s.Config.Extruders {
+		report.Tools = append(report.Tools, *tools[extruder])
+	}
+	return report
+}
+
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteCSV writes the timeline of the toolchanges, one row each
+func (r *Report) WriteCSV(w io.Writer) error {
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 3, 64)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"line", "time", "tool", "prev", "layer", "lead_time",
+		"preheat_line", "preheat_time", "deactivate", "kept_hot", "idle", "wait", "heating_shift",
+	})
+	for _, tc := range r.Toolchanges {
+		var preheatLine, preheatTime string
+		if tc.Preheat != nil {
+			preheatLine, preheatTime = strconv.Itoa(tc.Preheat.Line), f(tc.Preheat.Time)
+		}
+		cw.Write([]string{
+			strconv.Itoa(tc.Line), f(tc.Time), tc.Tool, tc.Prev, strconv.Itoa(tc.Layer), f(tc.LeadTime),
+			preheatLine, preheatTime, tc.Deactivate, strconv.FormatBool(tc.KeptHot), f(tc.Idle), f(tc.Wait), f(tc.HeatingShift),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
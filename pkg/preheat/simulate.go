@@ -0,0 +1,111 @@
+package preheat
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// ResidualWait is the wait at a toolchange where the lead time is not available
+type ResidualWait struct {
+	Line int     // line number of the toolchange
+	Time float64 // print time of the toolchange
+	Tool string
+	Wait float64
+}
+
+// Simulation compares the waits of the preheat plan against the baseline,
+// which waits the full heat up at every toolchange.
+type Simulation struct {
+	PrintTime    float64 // estimated print time without any waits
+	BaselineWait float64 // total waits without preheat
+	PlannedWait  float64 // total waits with the preheat plan
+	Residuals    []ResidualWait
+	Tools        []ToolReport
+}
+
+// Simulate estimates the waits of the toolchanges with and without the plan
+func (s *State) Simulate() *Simulation {
+	sim := &Simulation{
+		PrintTime: s.PrintTime,
+		Tools:     s.Report().Tools,
+	}
+
+	for i, tc := range s.Toolchanges {
+		if i == 0 || tc.Extruder == tc.Prev {
+			continue
+		}
+
+		// the baseline heats up from cold at the toolchange
+		sim.BaselineWait += tc.Extruder.LeadTime(-1, IdleOff)
+
+		if tc.Wait > 0 {
+			sim.PlannedWait += tc.Wait
+			sim.Residuals = append(sim.Residuals, ResidualWait{
+				Line: tc.Index + 1,
+				Time: s.Lines[tc.Index].PrintTime,
+				Tool: tc.Extruder.Name,
+				Wait: tc.Wait,
+			})
+		}
+	}
+	return sim
+}
+
+// residualWaitEpsilon is the residual wait ignored, only the float errors of
+// the print times. The preheat is inserted at the line started by the lead
+// time, so the line boundary never shortens it.
+const residualWaitEpsilon = 1e-6 // seconds
+
+// residualWaits finds the time to wait at each toolchange with the plan,
+// where the lead time is not available.
+func (s *State) residualWaits() {
+	hot := make(map[*Extruder]bool)
+	for i, tc := range s.Toolchanges {
+		if i == 0 {
+			hot[tc.Extruder] = true
+			continue
+		}
+		if tc.Prev != nil && tc.Prev != tc.Extruder {
+			// kept hot until it's used again
+			hot[tc.Prev] = tc.Idle == IdleKeep && !tc.FinalOff
+		}
+		if tc.Extruder == tc.Prev {
+			continue
+		}
+
+		switch {
+		case tc.PreheatIndex >= 0:
+			// the preheat might be later than the lead time, e.g. clamped
+			// to the start of the print, snapped to a later boundary or
+			// shifted by the heating limits
+			printTime := s.Lines[tc.Index].PrintTime
+			tc.Wait = math.Max(tc.LeadTime-(printTime-s.Lines[tc.PreheatIndex].PrintTime), 0)
+		case !hot[tc.Extruder]:
+			tc.Wait = tc.Extruder.LeadTime(-1, IdleOff)
+		}
+		if tc.Wait < residualWaitEpsilon {
+			tc.Wait = 0
+		}
+		hot[tc.Extruder] = true
+	}
+}
+
+func (sim *Simulation) Print(w io.Writer) {
+	fmt.Fprintf(w, "estimated print time:  %.1fs\n", sim.PrintTime)
+	fmt.Fprintf(w, "without preheat:       %.1fs (waits %.1fs)\n", sim.PrintTime+sim.BaselineWait, sim.BaselineWait)
+	fmt.Fprintf(w, "with preheat:          %.1fs (waits %.1fs)\n", sim.PrintTime+sim.PlannedWait, sim.PlannedWait)
+	fmt.Fprintf(w, "saved:                 %.1fs\n", sim.BaselineWait-sim.PlannedWait)
+
+	if len(sim.Residuals) > 0 {
+		fmt.Fprintf(w, "\nresidual waits:\n")
+		for _, r := range sim.Residuals {
+			fmt.Fprintf(w, "  line %d @ %.1fs: %s waits %.1fs\n", r.Line, r.Time, r.Tool, r.Wait)
+		}
+	}
+
+	fmt.Fprintf(w, "\nhot idle time:\n")
+	for _, t := range sim.Tools {
+		fmt.Fprintf(w, "  %s: %.1fs of %.1fs idle\n", t.Name, t.HotIdleTime, t.IdleTime)
+	}
+}
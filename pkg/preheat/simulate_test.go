@@ -0,0 +1,47 @@
+package preheat
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	// the moves are longer than a second, the line boundaries cost no wait
+	state, output := runPreheat(t, testConfig(), toolFile("T0", 10, "T1", 10, "T0", 10, "T1", 10))
+	sim := state.Simulate()
+	if len(sim.Residuals) != 0 || sim.PlannedWait != 0 {
+		t.Errorf("residual waits %+v, want none", sim.Residuals)
+	}
+	if sim.BaselineWait != 3*20 {
+		t.Errorf("baseline waits %.1fs, want %.1fs", sim.BaselineWait, 3*20.0)
+	}
+	if strings.Contains(output, "M116") || strings.Contains(output, "not fully preheated") {
+		t.Errorf("wait gcode in the output")
+	}
+}
+
+func TestResidualWait(t *testing.T) {
+	// T1 could only be preheated from the first toolchange
+	state, output := runPreheat(t, testConfig(), toolFile("T0", 2, "T1", 10))
+	tc := state.Toolchanges[1]
+	first := state.Toolchanges[0].Index + 1
+	if tc.PreheatIndex != first {
+		t.Fatalf("preheated at line %d, want %d", tc.PreheatIndex+1, first+1)
+	}
+
+	want := 20 - (state.Lines[tc.Index].PrintTime - state.Lines[first].PrintTime)
+	if math.Abs(tc.Wait-want) > 1e-9 {
+		t.Errorf("waits %.2fs, want %.2fs", tc.Wait, want)
+	}
+	sim := state.Simulate()
+	if len(sim.Residuals) != 1 || sim.Residuals[0].Line != tc.Index+1 || sim.Residuals[0].Tool != "T1" {
+		t.Errorf("residual waits %+v, want one of T1 at line %d", sim.Residuals, tc.Index+1)
+	}
+	if !strings.Contains(output, "\nM116 P1\nT1\n") {
+		t.Errorf("no wait gcode before the toolchange")
+	}
+	if !strings.HasSuffix(output, "; preheat: 1 toolchanges are not fully preheated\n") {
+		t.Errorf("no short preheat comment at the end")
+	}
+}
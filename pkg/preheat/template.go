@@ -0,0 +1,203 @@
+package preheat
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+// TemplateContext is the template data of the gcodes inserted by preheat
+type TemplateContext struct {
+	Name  string // name of the extruder of the gcode
+	Index int    // index of the extruder of the gcode
+
+	Tool      string  // name of the extruder selected by the toolchange
+	ToolIndex int     // index of the extruder selected by the toolchange
+	Prev      string  // name of the previous extruder, empty if none
+	PrevIndex int     // index of the previous extruder, -1 if none
+	PrintTime float64 // print time of the toolchange, in seconds
+	LeadTime  float64 // lead time of the preheat, in seconds
+	Temp      float64 // target temperature of the extruder from the gcode file or the slicer metadata, 0 if unknown
+	Layer     int     // layer number of the toolchange, starts from 1
+	Wait      float64 // residual time to wait for the extruder to heat up, in seconds
+
+	// temperatures of the extruder from the slicer metadata, 0 if unknown
+	FirstLayerTemp float64
+	PrintTemp      float64
+	StandbyTemp    float64
+
+	Slicer *SlicerMetadata // temperatures of all the tools
+}
+
+// extruderTemplates are the compiled gcodes of an extruder
+type extruderTemplates struct {
+	active  *template.Template
+	standby *template.Template
+	off     *template.Template
+	final   *template.Template
+	wait    *template.Template
+}
+
+var trailingDigits = regexp.MustCompile(`(\d+)$`)
+
+// tempField matches the use of .Temp in a template
+var tempField = regexp.MustCompile(`\.Temp\b`)
+
+// resolveIndex returns the configured index, or the number in the name
+// (T1 is 1), or the position in the config.
+func (e *Extruder) resolveIndex(position int) int {
+	if e.Index != nil {
+		return *e.Index
+	}
+	if m := trailingDigits.FindString(e.Name); m != "" {
+		if i, err := strconv.Atoi(m); err == nil {
+			return i
+		}
+	}
+	return position
+}
+
+// applyDefaults fills the missing settings from the defaults
+func (e *Extruder) applyDefaults(d *Extruder) {
+	if d == nil {
+		return
+	}
+	if e.HeatUp == 0 {
+		e.HeatUp = d.HeatUp
+	}
+	if e.ActiveGcode == "" {
+		e.ActiveGcode = d.ActiveGcode
+	}
+	if e.DeactivateGcode == "" {
+		e.DeactivateGcode = d.DeactivateGcode
+	}
+	if e.Thermal == nil {
+		e.Thermal = d.Thermal
+	}
+	if e.MinIdleForStandby == 0 {
+		e.MinIdleForStandby = d.MinIdleForStandby
+	}
+	if e.StandbyGcode == "" {
+		e.StandbyGcode = d.StandbyGcode
+	}
+	if e.MinIdleForOff == 0 {
+		e.MinIdleForOff = d.MinIdleForOff
+	}
+	if e.OffGcode == "" {
+		e.OffGcode = d.OffGcode
+	}
+	if e.FinalOffGcode == "" {
+		e.FinalOffGcode = d.FinalOffGcode
+	}
+	if e.WaitGcode == "" {
+		e.WaitGcode = d.WaitGcode
+	}
+	if e.HeaterPower == 0 {
+		e.HeaterPower = d.HeaterPower
+	}
+}
+
+func (e *Extruder) compileTemplates() error {
+	compile := func(name, text string) (*template.Template, error) {
+		if text == "" {
+			return nil, nil
+		}
+		t, err := template.New(e.Name + "." + name).Funcs(sprig.TxtFuncMap()).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s template: %w", name, err)
+		}
+		return t, nil
+	}
+
+	var err error
+	if e.templates.active, err = compile("active_gcode", e.ActiveGcode); err != nil {
+		return err
+	}
+	if e.templates.standby, err = compile("standby_gcode", e.StandbyGcode); err != nil {
+		return err
+	}
+	if e.templates.off, err = compile("off_gcode", e.OffGcode); err != nil {
+		return err
+	}
+	if e.templates.final, err = compile("final_off_gcode", e.FinalOffGcode); err != nil {
+		return err
+	}
+	if e.templates.wait, err = compile("wait_gcode", e.WaitGcode); err != nil {
+		return err
+	}
+	return nil
+}
+
+// render executes the template with the context of the extruder. The
+// temperature is unknown if it's 0, a template using it is warned, e.g.
+// M104 S{{.Temp}} would turn the heater off.
+func (s *State) render(e *Extruder, t *template.Template, ctx TemplateContext) (string, error) {
+	if t == nil {
+		return "", nil
+	}
+	ctx.Name = e.Name
+	ctx.Index = e.index
+	if m := ctx.Slicer; m != nil {
+		ctx.FirstLayerTemp = m.FirstLayerTemp(e.index)
+		ctx.PrintTemp = m.PrintTemp(e.index)
+		ctx.StandbyTemp = m.StandbyTemp(e.index)
+		if ctx.Temp == 0 {
+			ctx.Temp = m.Temp(e.index, ctx.Layer)
+		}
+	}
+	if ctx.Temp == 0 && tempField.MatchString(t.Root.String()) {
+		s.Log.Warnf("unknown temperature of %s in %s at %.1f, .Temp is 0", e.Name, t.Name(), ctx.PrintTime)
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, &ctx); err != nil {
+		return "", fmt.Errorf("failed to execute template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// toolchangeContext returns the template context of a toolchange
+func (s *State) toolchangeContext(tc *Toolchange) TemplateContext {
+	ctx := TemplateContext{
+		Tool:      tc.Extruder.Name,
+		ToolIndex: tc.Extruder.index,
+		PrevIndex: -1,
+		PrintTime: s.Lines[tc.Index].PrintTime,
+		LeadTime:  tc.LeadTime,
+		Temp:      tc.Temp,
+		Layer:     tc.Layer,
+		Slicer:    s.Metadata,
+	}
+	if tc.Prev != nil {
+		ctx.Prev = tc.Prev.Name
+		ctx.PrevIndex = tc.Prev.index
+	}
+	return ctx
+}
+
+// rewrite is a temperature gcode rewritten into the gcode of the extruder
+type rewrite struct {
+	index    int // index of the line
+	extruder *Extruder
+	tmpl     *template.Template
+	ctx      TemplateContext
+}
+
+// renderRewrites renders the rewritten temperature gcodes after the scan
+func (s *State) renderRewrites() error {
+	for _, r := range s.rewrites {
+		line := &s.Lines[r.index]
+		r.ctx.PrintTime = line.PrintTime
+		r.ctx.Slicer = s.Metadata
+		code, err := s.render(r.extruder, r.tmpl, r.ctx)
+		if err != nil {
+			return fmt.Errorf("failed to rewrite line %d: %w", r.index+1, err)
+		}
+		line.Text = fmt.Sprintf("; rewritten by preheat: %s\n%s", line.Text, code)
+	}
+	return nil
+}
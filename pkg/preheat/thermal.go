@@ -0,0 +1,75 @@
+package preheat
+
+import (
+	"fmt"
+	"math"
+)
+
+// ThermalModel is a simple thermal model of a hotend. It heats up linearly at
+// full power, and cools down linearly or as first order towards the ambient.
+type ThermalModel struct {
+	HeatRate     float64 `yaml:"heat_rate"`     // °C/s when heating
+	CoolRate     float64 `yaml:"cool_rate"`     // °C/s when cooling, linear cooling
+	TimeConstant float64 `yaml:"time_constant"` // s, first order cooling, used if cool_rate is not set
+	Ambient      float64 `yaml:"ambient"`       // °C
+	Standby      float64 `yaml:"standby"`       // °C, temperature held by the standby gcode, ambient if not set
+	Print        float64 `yaml:"print"`         // °C, temperature when active
+}
+
+func (m *ThermalModel) Validate() error {
+	if m.HeatRate <= 0 {
+		return fmt.Errorf("thermal heat rate must be positive")
+	}
+	if m.CoolRate <= 0 && m.TimeConstant <= 0 {
+		return fmt.Errorf("thermal cool rate or time constant must be positive")
+	}
+	if m.Print <= m.Ambient {
+		return fmt.Errorf("thermal print temperature must be above ambient")
+	}
+	return nil
+}
+
+// Cool returns the temperature after cooling from temp towards the target
+// for the duration.
+func (m *ThermalModel) Cool(temp, target, duration float64) float64 {
+	if temp <= target {
+		return temp
+	}
+	if m.CoolRate > 0 {
+		temp -= m.CoolRate * duration
+	} else if m.TimeConstant > 0 {
+		temp = m.Ambient + (temp-m.Ambient)*math.Exp(-duration/m.TimeConstant)
+	}
+	return math.Max(temp, target)
+}
+
+// HeatTime returns the time to heat up from temp to the print temperature.
+func (m *ThermalModel) HeatTime(temp float64) float64 {
+	return math.Max(m.Print-temp, 0) / m.HeatRate
+}
+
+// LeadTime returns the time to preheat before the toolchange, for the
+// extruder idle for the duration since deactivated to the target temperature.
+//
+// The earlier the preheat starts, the hotter the extruder is, so the lead
+// time is the shortest one that covers the heat up time at that moment.
+func (m *ThermalModel) LeadTime(idle, target float64) float64 {
+	need := func(lead float64) float64 {
+		return m.HeatTime(m.Cool(m.Print, target, idle-lead))
+	}
+
+	// lead - need(lead) increases with lead, and it's positive at idle
+	lo, hi := 0.0, idle
+	if lo >= need(lo) {
+		return lo
+	}
+	for i := 0; i < 50 && hi-lo > 0.01; i++ {
+		mid := (lo + hi) / 2
+		if mid >= need(mid) {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
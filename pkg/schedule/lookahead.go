@@ -0,0 +1,157 @@
+package schedule
+
+import (
+	"fmt"
+
+	"github.com/alexjx/gcodeproc/pkg/timeline"
+)
+
+// LookaheadConfig moves the temperature changes of a single nozzle ahead, so
+// the nozzle is at the temperature when the filament is swapped.
+type LookaheadConfig struct {
+	HeatRate float64  `yaml:"heat_rate"` // °C/s when heating
+	CoolRate float64  `yaml:"cool_rate"` // °C/s when cooling, 0 to not move the cooling ahead
+	MaxLead  *float64 `yaml:"max_lead"`  // seconds, the longest time of the extruding moves printed at a changing temperature, 0 if not set
+	Tool     int      `yaml:"tool"`      // the tool of the nozzle, the gcodes without T are for it as well
+	AnyTool  bool     `yaml:"any_tool"`  // all the temperature gcodes are for the nozzle, whatever the T is
+}
+
+func (c *LookaheadConfig) Validate() error {
+	if c.HeatRate <= 0 {
+		return fmt.Errorf("lookahead heat rate must be positive")
+	}
+	if c.CoolRate < 0 {
+		return fmt.Errorf("lookahead cool rate cannot be negative")
+	}
+	if c.MaxLead != nil && *c.MaxLead < 0 {
+		return fmt.Errorf("lookahead max lead cannot be negative")
+	}
+	return nil
+}
+
+// maxLead returns the longest time of the extruding moves printed at a
+// changing temperature. None by default, the moves before the swap are
+// printed at the old temperature.
+func (c *LookaheadConfig) maxLead() float64 {
+	if c.MaxLead == nil {
+		return 0
+	}
+	return *c.MaxLead
+}
+
+// temperatureChange is a temperature gcode changing the target of the nozzle
+type temperatureChange struct {
+	index  int // index of the line
+	lower  int // the earliest line to move it to, after the previous temperature gcode
+	from   float64
+	to     float64
+	tool   timeline.NullableFloat64
+	lineNo int64
+}
+
+// TemperatureLookahead sets the temperature of each change ahead without
+// waiting, the change itself is kept so a M109 still waits for it.
+type TemperatureLookahead struct {
+	*timeline.Timeline
+
+	Config  *LookaheadConfig
+	target  float64 // current target of the nozzle, 0 if not set yet
+	lower   int     // line after the last temperature gcode of the nozzle
+	changes []*temperatureChange
+}
+
+func NewTemperatureLookahead(cfg *LookaheadConfig, tl *timeline.Timeline) *TemperatureLookahead {
+	return &TemperatureLookahead{
+		Timeline: tl,
+		Config:   cfg,
+	}
+}
+
+// Visit finds the temperature changes of the nozzle.
+func (s *TemperatureLookahead) Visit(g *timeline.Gcode) error {
+	if !g.Parsed || (g.Op != "M104" && g.Op != "M109") {
+		return nil
+	}
+	if !s.Config.AnyTool && g.T.Valid && int(g.T.Value) != s.Config.Tool {
+		return nil
+	}
+
+	// M109 R waits for cooling as well
+	target := g.S
+	if !target.Valid && g.Op == "M109" {
+		target = g.R
+	}
+	if !target.Valid {
+		return nil
+	}
+
+	index := int(g.LineNo - 1)
+	// the heater is turned off or set for the first time, nothing to move
+	if s.target > 0 && target.Value > 0 && target.Value != s.target {
+		s.changes = append(s.changes, &temperatureChange{
+			index:  index,
+			lower:  s.lower,
+			from:   s.target,
+			to:     target.Value,
+			tool:   g.T,
+			lineNo: g.LineNo,
+		})
+	}
+	s.target = target.Value
+	s.lower = index + 1
+	return nil
+}
+
+// Plan inserts the temperature of each change ahead by the time to reach it.
+func (s *TemperatureLookahead) Plan() error {
+	cfg := s.Config
+	maxLead := cfg.maxLead()
+	for _, c := range s.changes {
+		var lead float64
+		if c.to > c.from {
+			lead = (c.to - c.from) / cfg.HeatRate
+		} else if cfg.CoolRate > 0 {
+			lead = (c.from - c.to) / cfg.CoolRate
+		} else {
+			continue
+		}
+
+		// the nozzle must reach the temperature by the change, e.g. heats
+		// during the swap. It's moved freely across the lines not extruding,
+		// e.g. the travels and the swap, the extruding moves of the outgoing
+		// filament are printed at the changing temperature up to max lead,
+		// none by default. It does not pass the previous temperature gcode,
+		// the moves before it are printed at its temperature.
+		printTime := s.Lines[c.index].PrintTime
+		index, lower := c.index, c.lower
+		var extruding float64
+		for i := c.index - 1; i >= c.lower; i-- {
+			line := s.Lines[i]
+			if line.Move && line.Boundary&timeline.BoundaryTravel == 0 {
+				extruding += line.Time
+				if extruding > maxLead {
+					lower = i + 1
+					break
+				}
+			}
+			index = i
+			if printTime-line.PrintTime >= lead {
+				break
+			}
+		}
+		index = s.Snap(index, lower, c.index)
+		if index >= c.index {
+			continue
+		}
+
+		code := fmt.Sprintf("M104 S%g", c.to)
+		if c.tool.Valid {
+			code = fmt.Sprintf("M104 T%d S%g", int(c.tool.Value), c.to)
+		}
+		aheadTime := s.Lines[index].PrintTime
+		s.Log.Debugf("temperature %.0f -> %.0f at line %d set ahead @ %.1f, lead %.1f", c.from, c.to, c.lineNo, aheadTime, lead)
+		s.Insert(index, fmt.Sprintf("; LOOKAHEAD %.0f -> %.0f [%.1f -> %.1f] (lead %.1f)\n%s",
+			c.from, c.to, aheadTime, printTime, lead, code))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestTemperatureLookahead(t *testing.T) {
+	// 5 extruding moves, 2 travels, and the swap heating from 200 to 240
+	input := "M83\nM104 S200\nG1 X0 Y0 F1800\n" + moves(5) + "G1 X0 Y50\nG1 X0 Y0\nT1\nM109 S240\n" + moves(3)
+	const (
+		travel = 8 // index of the first travel
+		swap   = 11
+	)
+
+	tests := []struct {
+		maxLead *float64
+		index   int // index of the line the temperature is set before
+	}{
+		// the extruding moves keep the old temperature
+		{maxLead: nil, index: travel},
+		{maxLead: ptr(0), index: travel},
+		// one extruding move of 3.4s, not two
+		{maxLead: ptr(5), index: travel - 1},
+		// the whole lead of 20s
+		{maxLead: ptr(100), index: travel - 5},
+	}
+	for _, tt := range tests {
+		name := "unset"
+		if tt.maxLead != nil {
+			name = fmt.Sprint(*tt.maxLead)
+		}
+		t.Run(name, func(t *testing.T) {
+			cfg := &Config{Lookahead: &LookaheadConfig{HeatRate: 2, MaxLead: tt.maxLead}}
+			p, output := runSchedule(t, cfg, input)
+
+			for i, codes := range p.Timeline.Inserts {
+				if i != tt.index {
+					t.Errorf("temperature set before line %d, want %d", i+1, tt.index+1)
+				}
+				if len(codes) != 1 || !strings.HasSuffix(codes[0], "\nM104 S240") {
+					t.Errorf("inserted %q, want M104 S240", codes)
+				}
+			}
+			if len(p.Timeline.Inserts) != 1 {
+				t.Errorf("%d inserts, want 1", len(p.Timeline.Inserts))
+			}
+
+			lines := p.Timeline.Lines
+			if lead := lines[swap].PrintTime - lines[tt.index].PrintTime; tt.maxLead != nil && *tt.maxLead == 100 && lead < 20 {
+				t.Errorf("temperature set %.2fs ahead, want 20s", lead)
+			}
+			if !strings.Contains(output, "\nT1\nM109 S240\n") {
+				t.Errorf("the wait at the swap is not kept")
+			}
+		})
+	}
+}
+
+func TestLookaheadValidate(t *testing.T) {
+	if err := (&LookaheadConfig{HeatRate: 2, MaxLead: ptr(-1)}).Validate(); err == nil {
+		t.Errorf("negative max lead is accepted")
+	}
+	if err := (&LookaheadConfig{}).Validate(); err == nil {
+		t.Errorf("zero heat rate is accepted")
+	}
+}
+
+func ptr(v float64) *float64 {
+	return &v
+}
@@ -0,0 +1,303 @@
+package schedule
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+	"github.com/alexjx/gcodeproc/pkg/pipeline"
+	"github.com/alexjx/gcodeproc/pkg/preheat"
+	"github.com/alexjx/gcodeproc/pkg/timeline"
+	"github.com/sirupsen/logrus"
+)
+
+// Event is an event in the gcode file, with the action inserted a
+// lead time before it.
+type Event struct {
+	Name   string                      `yaml:"name"`
+	Match  []*timeline.ToolchangeMatch `yaml:"match"`
+	Lead   float64                     `yaml:"lead"`   // seconds before the event
+	Action string                      `yaml:"action"` // go template
+	Once   bool                        `yaml:"once"`   // only before the first occurrence
+	Cost   float64                     `yaml:"cost"`   // seconds the event takes, e.g. a filament swap
+
+	template *template.Template
+}
+
+// EventContext is the template data of the actions
+type EventContext struct {
+	Name      string   // name of the event
+	Count     int      // occurrence of the event, starts from 1
+	LineNo    int      // line number of the event
+	Line      string   // line of the event
+	Groups    []string // submatches of the regex of the matched rule
+	PrintTime float64  // print time of the event, in seconds
+	Lead      float64  // lead time of the action, in seconds
+	Layer     int      // layer number of the event
+}
+
+// Config is the events to schedule, and the presets. The
+// costs, kinematics and insertion are shared by all of them.
+type Config struct {
+	Costs      *timeline.GcodeCost        `yaml:"costs"`
+	Kinematics *timeline.KinematicsConfig `yaml:"kinematics"`
+	Insertion  *timeline.InsertionConfig  `yaml:"insertion"`
+	Events     []*Event                   `yaml:"events"`
+	Preheat    *preheat.Config            `yaml:"preheat"`
+	Lookahead  *LookaheadConfig           `yaml:"temperature_lookahead"`
+}
+
+// Validate checks the config, and fills the defaults
+func (cfg *Config) Validate() error {
+	if len(cfg.Events) == 0 && cfg.Preheat == nil && cfg.Lookahead == nil {
+		return fmt.Errorf("no events, preheat or temperature lookahead defined")
+	}
+	for _, event := range cfg.Events {
+		if event.Name == "" {
+			return fmt.Errorf("event name cannot be empty")
+		}
+		if len(event.Match) == 0 {
+			return fmt.Errorf("event %s: match cannot be empty", event.Name)
+		}
+		for _, m := range event.Match {
+			if err := m.Compile(); err != nil {
+				return fmt.Errorf("event %s: %w", event.Name, err)
+			}
+		}
+		if event.Lead < 0 || event.Cost < 0 {
+			return fmt.Errorf("event %s: lead time and cost cannot be negative", event.Name)
+		}
+		if event.Action == "" {
+			if event.Cost == 0 {
+				return fmt.Errorf("event %s: action cannot be empty", event.Name)
+			}
+			// only for the time it takes
+			continue
+		}
+		t, err := template.New(event.Name).Funcs(sprig.TxtFuncMap()).Parse(event.Action)
+		if err != nil {
+			return fmt.Errorf("event %s: failed to parse action template: %w", event.Name, err)
+		}
+		event.template = t
+	}
+	if cfg.Insertion != nil {
+		if err := cfg.Insertion.Validate(); err != nil {
+			return err
+		}
+	}
+	if cfg.Lookahead != nil {
+		if err := cfg.Lookahead.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if p := cfg.Preheat; p != nil {
+		// the preset runs on the same timeline
+		if p.Costs == nil {
+			p.Costs = cfg.Costs
+		} else if cfg.Costs == nil {
+			cfg.Costs = p.Costs
+		}
+		if p.Kinematics == nil {
+			p.Kinematics = cfg.Kinematics
+		} else if cfg.Kinematics == nil {
+			cfg.Kinematics = p.Kinematics
+		}
+		if p.Insertion == nil {
+			p.Insertion = cfg.Insertion
+		} else if cfg.Insertion == nil {
+			cfg.Insertion = p.Insertion
+		}
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("preheat: %w", err)
+		}
+	}
+	return nil
+}
+
+type occurrence struct {
+	event  *Event
+	index  int // index of the event line
+	count  int
+	line   string
+	groups []string
+	layer  int
+}
+
+// EventScheduler inserts the action of each event a lead time before it
+type EventScheduler struct {
+	*timeline.Timeline
+
+	Events      []*Event
+	occurrences []*occurrence
+	counts      map[*Event]int
+}
+
+func NewEventScheduler(events []*Event, tl *timeline.Timeline) *EventScheduler {
+	return &EventScheduler{
+		Timeline: tl,
+		Events:   events,
+		counts:   make(map[*Event]int),
+	}
+}
+
+// Visit finds the events.
+func (s *EventScheduler) Visit(g *timeline.Gcode) error {
+	for _, event := range s.Events {
+		for _, m := range event.Match {
+			if !m.Match(g) {
+				continue
+			}
+			// the line is still tracked as usual, e.g. a move
+			g.Cost += event.Cost
+			s.counts[event]++
+			if event.template != nil && (!event.Once || s.counts[event] == 1) {
+				s.occurrences = append(s.occurrences, &occurrence{
+					event:  event,
+					index:  int(g.LineNo - 1),
+					count:  s.counts[event],
+					line:   g.Line,
+					groups: m.Groups(g),
+					layer:  s.Layer,
+				})
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Plan inserts the actions of the events.
+func (s *EventScheduler) Plan() error {
+	for _, o := range s.occurrences {
+		event := o.event
+		printTime := s.Lines[o.index].PrintTime
+		// the line started by the time, so the action gets the full lead time
+		index := s.LineBefore(printTime - event.Lead)
+		if index > o.index {
+			index = o.index
+		}
+		index = s.Snap(index, 0, o.index)
+
+		ctx := EventContext{
+			Name:      event.Name,
+			Count:     o.count,
+			LineNo:    o.index + 1,
+			Line:      o.line,
+			Groups:    o.groups,
+			PrintTime: printTime,
+			Lead:      event.Lead,
+			Layer:     o.layer,
+		}
+		var b bytes.Buffer
+		if err := event.template.Execute(&b, &ctx); err != nil {
+			return fmt.Errorf("failed to render action of %s: %w", event.Name, err)
+		}
+
+		actionTime := s.Lines[index].PrintTime
+		s.Log.Debugf("schedule %s @ %.1f for %.1f", event.Name, actionTime, printTime)
+		s.Insert(index, fmt.Sprintf("; SCHEDULE %s [%.1f -> %.1f]\n%s", event.Name, actionTime, printTime, b.String()))
+	}
+	return nil
+}
+
+// Options are the settings of a run, besides the config
+type Options struct {
+	SpeedChangeRatio float64            // rough estimation with the ratio of speed change phase if positive, instead of kinematics
+	Debug            bool               // appends the time of the moves and the toolchanges of the preheat as comments
+	Logger           logrus.FieldLogger // nothing is logged if nil
+	Precision        *int               // decimal places of the edited numbers, gcode.DefaultPrecision if nil
+}
+
+// output returns the settings of the output, nil if the options are nil
+func (o *Options) output() *pipeline.Options {
+	if o == nil {
+		return nil
+	}
+	return &pipeline.Options{Precision: o.Precision}
+}
+
+// Result is the outcome of the schedule
+type Result struct {
+	Preheat *preheat.Result // nil without the preheat preset
+}
+
+// Schedule reads the gcode, and writes it with the actions inserted. The
+// config must be validated.
+func Schedule(r io.Reader, w io.Writer, cfg *Config, opts *Options) (*Result, error) {
+	p := NewProcessor(cfg, opts)
+	if err := pipeline.Run(r, w, p, opts.output()); err != nil {
+		return nil, err
+	}
+	return p.Result(), nil
+}
+
+// Processor is the schedule in a pipeline. The whole file is needed to plan,
+// so the lines are emitted when it's flushed.
+type Processor struct {
+	Timeline   *timeline.Timeline
+	Schedulers []timeline.Scheduler
+
+	visitors []timeline.Visitor
+	preheat  *preheat.State
+	debug    bool
+}
+
+// NewProcessor creates the processor of a validated config
+func NewProcessor(cfg *Config, opts *Options) *Processor {
+	if opts == nil {
+		opts = &Options{}
+	}
+	tl := timeline.NewTimeline(cfg.Costs, cfg.Kinematics, cfg.Insertion, opts.SpeedChangeRatio, opts.Logger)
+	p := &Processor{Timeline: tl, debug: opts.Debug}
+
+	// the events are matched before the preheat rewrites any line
+	if len(cfg.Events) > 0 {
+		p.Schedulers = append(p.Schedulers, NewEventScheduler(cfg.Events, tl))
+	}
+	if cfg.Lookahead != nil {
+		p.Schedulers = append(p.Schedulers, NewTemperatureLookahead(cfg.Lookahead, tl))
+	}
+	if cfg.Preheat != nil {
+		p.preheat = preheat.NewState(cfg.Preheat, tl)
+		p.Schedulers = append(p.Schedulers, p.preheat)
+	}
+
+	p.visitors = make([]timeline.Visitor, len(p.Schedulers))
+	for i, s := range p.Schedulers {
+		p.visitors[i] = s
+	}
+	return p
+}
+
+// Push tracks the time of each line, the first pass
+func (p *Processor) Push(line *gcode.Line, emit pipeline.Emit) error {
+	return p.Timeline.Add(line, p.visitors...)
+}
+
+// Flush inserts the actions, the second pass, and emits all the lines.
+func (p *Processor) Flush(emit pipeline.Emit) error {
+	p.Timeline.Settle()
+	for _, s := range p.Schedulers {
+		if err := s.Plan(); err != nil {
+			return err
+		}
+	}
+
+	if p.debug && p.preheat != nil {
+		p.preheat.DebugComments()
+	}
+	return p.Timeline.Emit(emit)
+}
+
+// Result returns the outcome after the processor is flushed
+func (p *Processor) Result() *Result {
+	result := &Result{}
+	if p.preheat != nil {
+		result.Preheat = p.preheat.Result()
+	}
+	return result
+}
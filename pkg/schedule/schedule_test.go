@@ -0,0 +1,100 @@
+package schedule
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/alexjx/gcodeproc/pkg/pipeline"
+	"github.com/alexjx/gcodeproc/pkg/timeline"
+)
+
+// runSchedule runs the schedule of the config over the gcode
+func runSchedule(t *testing.T, cfg *Config, input string) (*Processor, string) {
+	t.Helper()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("failed to validate: %v", err)
+	}
+	p := NewProcessor(cfg, nil)
+	var b bytes.Buffer
+	if err := pipeline.Run(strings.NewReader(input), &b, p, nil); err != nil {
+		t.Fatalf("failed to schedule: %v", err)
+	}
+	return p, b.String()
+}
+
+// moves generates the count of extruding moves of about 3.4s
+func moves(count int) string {
+	var b strings.Builder
+	for i := 0; i < count; i++ {
+		fmt.Fprintf(&b, "G1 X%d E5\n", 100*((i+1)%2))
+	}
+	return b.String()
+}
+
+func TestEventLead(t *testing.T) {
+	input := "M83\nG1 X0 Y0 F1800\n" + moves(10) + "T1\n" + moves(10) + "T0\n" + moves(3) + "T1\n"
+	for _, lead := range []float64{0, 5, 12.5, 20} {
+		t.Run(fmt.Sprint(lead), func(t *testing.T) {
+			cfg := &Config{Events: []*Event{{
+				Name:   "preload",
+				Match:  []*timeline.ToolchangeMatch{{Regex: `^T(\d)`}},
+				Lead:   lead,
+				Action: "PRELOAD GATE={{index .Groups 1}}",
+			}}}
+			p, output := runSchedule(t, cfg, input)
+			if n := strings.Count(output, "\nPRELOAD GATE="); n != 3 {
+				t.Fatalf("%d actions in the output, want 3", n)
+			}
+
+			// the actions are in the order of the events
+			var events, actions []int
+			for i, line := range p.Timeline.Lines {
+				if strings.HasPrefix(line.Text, "T") {
+					events = append(events, i)
+				}
+				if len(p.Timeline.Inserts[i]) > 0 {
+					actions = append(actions, i)
+				}
+			}
+			if len(actions) != len(events) {
+				t.Fatalf("actions inserted at %d lines, want %d", len(actions), len(events))
+			}
+			lines := p.Timeline.Lines
+			for i, event := range events {
+				ahead := lines[event].PrintTime - lines[actions[i]].PrintTime
+				if ahead < lead && actions[i] > 0 {
+					t.Errorf("action of line %d is %.2fs ahead, want %.2fs", event+1, ahead, lead)
+				}
+			}
+		})
+	}
+}
+
+func TestEventCost(t *testing.T) {
+	input := "G1 X0 Y0 F6000\nG1 X100\nG1 X50 Z1\nG1 X0\n"
+	plain, _ := runSchedule(t, &Config{Events: []*Event{{
+		Name:  "none",
+		Match: []*timeline.ToolchangeMatch{{Op: "M999"}},
+		Cost:  10,
+	}}}, input)
+	p, _ := runSchedule(t, &Config{Events: []*Event{{
+		Name:  "layer",
+		Match: []*timeline.ToolchangeMatch{{Regex: `^G1 X50 Z`}},
+		Cost:  10,
+	}}}, input)
+
+	lines, want := p.Timeline.Lines, plain.Timeline.Lines
+	if lines[2].Time < 10+want[2].Time {
+		t.Errorf("time of the event %.2fs, want the move and the cost at least %.2fs", lines[2].Time, 10+want[2].Time)
+	}
+	// the matched move is tracked, the next move starts from X50
+	if math.Abs(lines[3].Time-want[3].Time) > 1e-9 {
+		t.Errorf("time after the event %.2fs, want %.2fs", lines[3].Time, want[3].Time)
+	}
+	if p.Timeline.State.X != 0 || p.Timeline.State.Z != 1 {
+		t.Errorf("position X%g Z%g, want X0 Z1", p.Timeline.State.X, p.Timeline.State.Z)
+	}
+}
@@ -0,0 +1,157 @@
+package substitute
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+	"github.com/alexjx/gcodeproc/pkg/pipeline"
+	"github.com/sirupsen/logrus"
+)
+
+type Substitution struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+
+	fromRegex *regexp.Regexp
+	template  *template.Template
+}
+
+type Config struct {
+	Substitutions []*Substitution `yaml:"substitutions"`
+}
+
+// Validate compiles the regular expressions and the templates
+func (cfg *Config) Validate() error {
+	for _, s := range cfg.Substitutions {
+		re, err := regexp.Compile(s.From)
+		if err != nil {
+			return fmt.Errorf("failed to compile regex %s: %w", s.From, err)
+		}
+		s.fromRegex = re
+		tt := template.New(s.From).Funcs(sprig.TxtFuncMap())
+		tt, err = tt.Parse(s.To)
+		if err != nil {
+			return fmt.Errorf("failed to parse template: %w", err)
+		}
+		s.template = tt
+	}
+	return nil
+}
+
+type TemplateContext struct {
+	Matches [][]string
+}
+
+// Options are the settings of a run, besides the config
+type Options struct {
+	Logger    logrus.FieldLogger // nothing is logged if nil
+	Precision *int               // decimal places of the edited numbers, gcode.DefaultPrecision if nil
+}
+
+// output returns the settings of the output, nil if the options are nil
+func (o *Options) output() *pipeline.Options {
+	if o == nil {
+		return nil
+	}
+	return &pipeline.Options{Precision: o.Precision}
+}
+
+// Result is the outcome of the substitution
+type Result struct {
+	Lines       int64 // lines read
+	Substituted int64 // lines matched by any substitution
+}
+
+// Substitute reads the gcode, and writes it with the matching lines replaced
+// by the templates. The config must be validated.
+func Substitute(r io.Reader, w io.Writer, cfg *Config, opts *Options) (*Result, error) {
+	p := NewProcessor(cfg, opts)
+	if err := pipeline.Run(r, w, p, opts.output()); err != nil {
+		return nil, err
+	}
+	return p.Result(), nil
+}
+
+// Processor substitutes the lines as they are pushed
+type Processor struct {
+	cfg    *Config
+	log    logrus.FieldLogger
+	result Result
+}
+
+// NewProcessor creates the processor of a validated config
+func NewProcessor(cfg *Config, opts *Options) *Processor {
+	if opts == nil {
+		opts = &Options{}
+	}
+	log := opts.Logger
+	if log == nil {
+		l := logrus.New()
+		l.SetOutput(io.Discard)
+		l.SetLevel(logrus.PanicLevel)
+		log = l
+	}
+	return &Processor{cfg: cfg, log: log}
+}
+
+func (p *Processor) Push(l *gcode.Line, emit pipeline.Emit) error {
+	p.result.Lines++
+	line := l.String()
+
+	var (
+		matchesAny bool
+		matches    = make([][]string, len(p.cfg.Substitutions))
+	)
+	for i, s := range p.cfg.Substitutions {
+		matches[i] = s.fromRegex.FindStringSubmatch(line)
+		if len(matches[i]) > 0 {
+			matchesAny = true
+		}
+	}
+	if !matchesAny {
+		// no match, write line as is
+		return emit(l)
+	}
+	p.result.Substituted++
+	p.log.Debugf("substitute line %d: %s", p.result.Lines, line)
+
+	// provide matches as template data
+	data := &TemplateContext{
+		Matches: matches,
+	}
+
+	// render template into a temporary buffer
+	for _, s := range p.cfg.Substitutions {
+		var b bytes.Buffer
+		if err := s.template.Execute(&b, data); err != nil {
+			return fmt.Errorf("failed to execute template: %w", err)
+		}
+
+		ts := strings.ReplaceAll(b.String(), "\\n", "\n")
+		line = s.fromRegex.ReplaceAllString(line, ts)
+	}
+
+	// the next processors take one line at a time
+	for _, text := range strings.Split(line, "\n") {
+		if err := emit(gcode.NewLine(text)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Processor) Flush(emit pipeline.Emit) error {
+	return nil
+}
+
+// Result returns the outcome of the lines processed
+func (p *Processor) Result() *Result {
+	result := p.result
+	return &result
+}
@@ -0,0 +1,138 @@
+package timeline
+
+import "math"
+
+// Plane is the arc plane selected by G17/G18/G19
+type Plane int
+
+const (
+	PlaneXY Plane = iota // G17
+	PlaneZX              // G18
+	PlaneYZ              // G19
+)
+
+// arcEpsilon is the tolerance to treat the start and end point of an arc as the same
+const arcEpsilon = 1e-6
+
+// Arc is the geometry of a G2/G3 move, projected on the selected plane.
+type Arc struct {
+	Radius float64 // radius of the arc
+	Angle  float64 // angular travel in radians, always positive
+	Linear float64 // travel along the axis perpendicular to the plane (helix)
+
+	// unit tangent vectors in XYZ at the start and the end of the arc
+	StartDir [3]float64
+	EndDir   [3]float64
+}
+
+// Length returns the length of the (helical) arc.
+func (a Arc) Length() float64 {
+	return math.Hypot(a.Radius*a.Angle, a.Linear)
+}
+
+// Arc calculates the arc geometry of a G2/G3 move. X, Y and Z are the
+// relative distances from the current position to the end position.
+func (g *Gcode) Arc(plane Plane, X, Y, Z float64) Arc {
+	// map axes into the plane:
+	// p0, p1 are the axes in the plane, pl is the linear axis
+	// o0, o1 are the offsets of the center
+	var p0, p1, pl float64
+	var o0, o1 NullableFloat64
+	switch plane {
+	case PlaneZX:
+		p0, p1, pl = Z, X, Y
+		o0, o1 = g.K, g.I
+	case PlaneYZ:
+		p0, p1, pl = Y, Z, X
+		o0, o1 = g.J, g.K
+	default:
+		p0, p1, pl = X, Y, Z
+		o0, o1 = g.I, g.J
+	}
+
+	clockwise := g.Op == "G2"
+	arc := Arc{Linear: pl}
+
+	// c0, c1 is the center relative to the start
+	var c0, c1 float64
+	chord := math.Hypot(p0, p1)
+	if g.R.Valid {
+		// R form
+		// the chord between start and end, the arc spans over it
+		if chord < arcEpsilon {
+			// full circles can not be defined in R form
+			return arc
+		}
+		// firmwares make the arc a half circle if the radius is too small
+		arc.Radius = math.Max(math.Abs(g.R.Value), chord/2)
+		arc.Angle = 2 * math.Asin(math.Min(1.0, chord/(2*arc.Radius)))
+
+		// center is on the left of the chord for a short counter-clockwise arc
+		h := math.Sqrt(math.Max(arc.Radius*arc.Radius-chord*chord/4, 0))
+		if clockwise != (g.R.Value < 0) {
+			h = -h
+		}
+		c0 = p0/2 - p1/chord*h
+		c1 = p1/2 + p0/chord*h
+
+		if g.R.Value < 0 {
+			// negative radius selects the longer arc
+			arc.Angle = 2*math.Pi - arc.Angle
+		}
+	} else {
+		// IJK form
+		c0, c1 = o0.Value, o1.Value
+		arc.Radius = math.Hypot(c0, c1)
+		if arc.Radius < arcEpsilon {
+			return arc
+		}
+
+		// vectors from center to start and end
+		s0, s1 := -c0, -c1
+		e0, e1 := p0-c0, p1-c1
+		angle := math.Atan2(s0*e1-s1*e0, s0*e0+s1*e1)
+		if clockwise {
+			angle = -angle
+		}
+		if angle < 0 {
+			angle += 2 * math.Pi
+		}
+		if chord < arcEpsilon {
+			// start equals end, this is a full circle
+			angle = 2 * math.Pi
+		}
+		arc.Angle = angle
+	}
+
+	// P is the count of additional full circles
+	if g.P.Valid && g.P.Value > 0 {
+		arc.Angle += 2 * math.Pi * math.Floor(g.P.Value)
+	}
+
+	// tangents are perpendicular to the radius vectors, the helix
+	// tilts them towards the linear axis
+	length := arc.Length()
+	if length < arcEpsilon {
+		return arc
+	}
+	planar := arc.Radius * arc.Angle / length
+	tangent := func(v0, v1 float64) [3]float64 {
+		n := math.Hypot(v0, v1)
+		t0, t1 := -v1/n, v0/n
+		if clockwise {
+			t0, t1 = -t0, -t1
+		}
+		t0, t1, tl := t0*planar, t1*planar, pl/length
+		switch plane {
+		case PlaneZX:
+			return [3]float64{t1, tl, t0}
+		case PlaneYZ:
+			return [3]float64{tl, t0, t1}
+		}
+		return [3]float64{t0, t1, tl}
+	}
+	arc.StartDir = tangent(-c0, -c1)
+	arc.EndDir = tangent(p0-c0, p1-c1)
+
+	return arc
+}
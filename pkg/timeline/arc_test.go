@@ -0,0 +1,124 @@
+package timeline
+
+import (
+	"math"
+	"testing"
+)
+
+func TestArc(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		plane   Plane
+		x, y, z float64 // distances to the end
+		radius  float64
+		angle   float64
+		length  float64
+		start   [3]float64
+		end     [3]float64
+	}{
+		{
+			name: "quarter ijk", line: "G2 X10 Y10 I10 J0",
+			x: 10, y: 10,
+			radius: 10, angle: math.Pi / 2, length: 5 * math.Pi,
+			start: [3]float64{0, 1, 0}, end: [3]float64{1, 0, 0},
+		},
+		{
+			name: "three quarter ijk ccw", line: "G3 X10 Y10 I10 J0",
+			x: 10, y: 10,
+			radius: 10, angle: 3 * math.Pi / 2, length: 15 * math.Pi,
+			start: [3]float64{0, -1, 0}, end: [3]float64{-1, 0, 0},
+		},
+		{
+			name: "quarter r", line: "G2 X10 Y10 R10",
+			x: 10, y: 10,
+			radius: 10, angle: math.Pi / 2, length: 5 * math.Pi,
+			start: [3]float64{0, 1, 0}, end: [3]float64{1, 0, 0},
+		},
+		{
+			// the other center, the long way round
+			name: "negative r", line: "G2 X10 Y10 R-10",
+			x: 10, y: 10,
+			radius: 10, angle: 3 * math.Pi / 2, length: 15 * math.Pi,
+			start: [3]float64{-1, 0, 0}, end: [3]float64{0, -1, 0},
+		},
+		{
+			name: "r too small", line: "G2 X10 R1",
+			x:      10,
+			radius: 5, angle: math.Pi, length: 5 * math.Pi,
+			start: [3]float64{0, 1, 0}, end: [3]float64{0, -1, 0},
+		},
+		{
+			name: "half ijk", line: "G3 X10 I5",
+			x:      10,
+			radius: 5, angle: math.Pi, length: 5 * math.Pi,
+			start: [3]float64{0, -1, 0}, end: [3]float64{0, 1, 0},
+		},
+		{
+			name: "full circle", line: "G2 I5",
+			radius: 5, angle: 2 * math.Pi, length: 10 * math.Pi,
+			start: [3]float64{0, 1, 0}, end: [3]float64{0, 1, 0},
+		},
+		{
+			name: "full circle r", line: "G2 R5",
+		},
+		{
+			name: "extra circles", line: "G2 I5 P2",
+			radius: 5, angle: 6 * math.Pi, length: 30 * math.Pi,
+			start: [3]float64{0, 1, 0}, end: [3]float64{0, 1, 0},
+		},
+		{
+			name: "helix", line: "G2 Z4 I5",
+			z:      4,
+			radius: 5, angle: 2 * math.Pi, length: math.Hypot(10*math.Pi, 4),
+			start: [3]float64{0, 10 * math.Pi / math.Hypot(10*math.Pi, 4), 4 / math.Hypot(10*math.Pi, 4)},
+			end:   [3]float64{0, 10 * math.Pi / math.Hypot(10*math.Pi, 4), 4 / math.Hypot(10*math.Pi, 4)},
+		},
+		{
+			// Z is the first axis of the plane, X the second
+			name: "g18", line: "G2 X10 Z10 K10", plane: PlaneZX,
+			x: 10, z: 10,
+			radius: 10, angle: math.Pi / 2, length: 5 * math.Pi,
+			start: [3]float64{1, 0, 0}, end: [3]float64{0, 0, 1},
+		},
+		{
+			name: "g18 helix", line: "G3 Y3 K5", plane: PlaneZX,
+			y:      3,
+			radius: 5, angle: 2 * math.Pi, length: math.Hypot(10*math.Pi, 3),
+			start: [3]float64{-10 * math.Pi / math.Hypot(10*math.Pi, 3), 3 / math.Hypot(10*math.Pi, 3), 0},
+			end:   [3]float64{-10 * math.Pi / math.Hypot(10*math.Pi, 3), 3 / math.Hypot(10*math.Pi, 3), 0},
+		},
+		{
+			name: "g19", line: "G2 Y10 Z10 J10", plane: PlaneYZ,
+			y: 10, z: 10,
+			radius: 10, angle: math.Pi / 2, length: 5 * math.Pi,
+			start: [3]float64{0, 0, 1}, end: [3]float64{0, 1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := ParseGcode(tt.line, 1)
+			arc := g.Arc(tt.plane, tt.x, tt.y, tt.z)
+			if !near(arc.Radius, tt.radius) {
+				t.Errorf("radius = %v, want %v", arc.Radius, tt.radius)
+			}
+			if !near(arc.Angle, tt.angle) {
+				t.Errorf("angle = %v, want %v", arc.Angle, tt.angle)
+			}
+			if !near(arc.Length(), tt.length) {
+				t.Errorf("length = %v, want %v", arc.Length(), tt.length)
+			}
+			for i := range tt.start {
+				if !near(arc.StartDir[i], tt.start[i]) || !near(arc.EndDir[i], tt.end[i]) {
+					t.Errorf("directions = %v %v, want %v %v", arc.StartDir, arc.EndDir, tt.start, tt.end)
+					break
+				}
+			}
+		})
+	}
+}
+
+func near(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
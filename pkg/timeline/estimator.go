@@ -0,0 +1,427 @@
+package timeline
+
+import (
+	"math"
+)
+
+// Estimator estimates the execution time of move gcodes.
+//
+// Firmwares plan the moves with a lookahead, so the time of a move might
+// only be known after some of the following moves are seen. The estimator
+// sets Gcode.Time when the time of a move is settled.
+type Estimator interface {
+	// Push adds a move to the estimator. The state is the position before
+	// the move. It returns the gcodes whose time has been settled.
+	Push(g *Gcode, state *ExtruderState) []*Gcode
+
+	// Flush settles all pending moves, as the printer comes to a stop.
+	Flush() []*Gcode
+}
+
+// RatioEstimator is the rough estimator, it adds a fixed ratio on top of the
+// time of each move for the acceleration and deceleration.
+type RatioEstimator struct {
+	Ratio float64
+}
+
+func (e *RatioEstimator) Push(g *Gcode, state *ExtruderState) []*Gcode {
+	g.Time = 0
+	if feedrate := state.Feedrate * state.SpeedFactor; feedrate > 0 {
+		g.Time = g.Distance(state) / feedrate
+	}
+	g.Time += g.Time * e.Ratio
+	return []*Gcode{g}
+}
+
+func (e *RatioEstimator) Flush() []*Gcode {
+	return nil
+}
+
+// AxisLimits holds a limit for each axis, zero means no limit
+type AxisLimits struct {
+	X float64 `yaml:"x"`
+	Y float64 `yaml:"y"`
+	Z float64 `yaml:"z"`
+	E float64 `yaml:"e"`
+}
+
+// MotionLimits are the kinematic limits of the printer
+type MotionLimits struct {
+	MaxVelocity          float64    `yaml:"max_velocity"`           // mm/s, toolhead velocity
+	MaxAccel             float64    `yaml:"max_accel"`              // mm/s^2, toolhead acceleration
+	TravelAccel          float64    `yaml:"travel_accel"`           // mm/s^2, for moves without extrusion, max_accel if zero
+	RetractAccel         float64    `yaml:"retract_accel"`          // mm/s^2, for extruder only moves, max_accel if zero
+	SquareCornerVelocity float64    `yaml:"square_corner_velocity"` // mm/s, klipper style cornering
+	JunctionDeviation    float64    `yaml:"junction_deviation"`     // mm, marlin style cornering, overrides square_corner_velocity
+	AxisVelocity         AxisLimits `yaml:"axis_velocity"`          // mm/s, per axis
+	AxisAccel            AxisLimits `yaml:"axis_accel"`             // mm/s^2, per axis
+}
+
+// Update changes the limits by the gcodes from the slicer or macros:
+//
+//	M201 X Y Z E: per axis max acceleration
+//	M203 X Y Z E: per axis max velocity (mm/s as marlin)
+//	M204 S/P/T/R: acceleration, print/travel/retract acceleration
+//	M205 J: junction deviation, X/Y: jerk, taken as the square corner velocity
+//	SET_VELOCITY_LIMIT VELOCITY= ACCEL= SQUARE_CORNER_VELOCITY=
+func (l *MotionLimits) Update(g *Gcode) {
+	axes := func(limits *AxisLimits) {
+		if g.X.Valid {
+			limits.X = g.X.Value
+		}
+		if g.Y.Valid {
+			limits.Y = g.Y.Value
+		}
+		if g.Z.Valid {
+			limits.Z = g.Z.Value
+		}
+		if g.E.Valid {
+			limits.E = g.E.Value
+		}
+	}
+
+	switch g.Op {
+	case "M201":
+		axes(&l.AxisAccel)
+	case "M203":
+		axes(&l.AxisVelocity)
+	case "M204":
+		if g.S.Valid {
+			// legacy, sets both print and travel
+			l.MaxAccel = g.S.Value
+			l.TravelAccel = g.S.Value
+		}
+		if g.P.Valid {
+			l.MaxAccel = g.P.Value
+		}
+		if g.T.Valid {
+			l.TravelAccel = g.T.Value
+		}
+		if g.R.Valid {
+			l.RetractAccel = g.R.Value
+		}
+	case "M205":
+		if g.J.Valid {
+			l.JunctionDeviation = g.J.Value
+		}
+		if g.X.Valid || g.Y.Valid {
+			// a 90 degree corner changes the velocity of both axes,
+			// so the jerk is about the velocity of a square corner
+			jerk := math.Inf(1)
+			if g.X.Valid {
+				jerk = g.X.Value
+			}
+			if g.Y.Valid {
+				jerk = math.Min(jerk, g.Y.Value)
+			}
+			l.SquareCornerVelocity = jerk
+		}
+	case "SET_VELOCITY_LIMIT":
+		if v := g.Param("VELOCITY"); v.Valid {
+			l.MaxVelocity = v.Value
+		}
+		if v := g.Param("ACCEL"); v.Valid {
+			// klipper has only one acceleration
+			l.MaxAccel = v.Value
+			l.TravelAccel = 0
+			l.RetractAccel = 0
+		}
+		if v := g.Param("SQUARE_CORNER_VELOCITY"); v.Valid {
+			l.SquareCornerVelocity = v.Value
+		}
+	}
+}
+
+// Deviation returns the junction deviation used for cornering.
+func (l *MotionLimits) Deviation() float64 {
+	if l.JunctionDeviation > 0 {
+		return l.JunctionDeviation
+	}
+	if l.MaxAccel <= 0 {
+		return 0
+	}
+	// same as klipper
+	return l.SquareCornerVelocity * l.SquareCornerVelocity * (math.Sqrt2 - 1) / l.MaxAccel
+}
+
+// HomePosition is the position after homing
+type HomePosition struct {
+	X float64 `yaml:"x"`
+	Y float64 `yaml:"y"`
+	Z float64 `yaml:"z"`
+}
+
+type KinematicsConfig struct {
+	MotionLimits `yaml:",inline"`
+
+	Home HomePosition `yaml:"home"`
+
+	// number of moves the planner could look ahead
+	Lookahead int `yaml:"lookahead"`
+}
+
+// Limits returns the initial limits, with defaults for the missing ones
+func (c *KinematicsConfig) Limits() MotionLimits {
+	l := c.MotionLimits
+	if l.MaxVelocity <= 0 {
+		l.MaxVelocity = DefaultKinematics.MaxVelocity
+	}
+	if l.MaxAccel <= 0 {
+		l.MaxAccel = DefaultKinematics.MaxAccel
+	}
+	return l
+}
+
+// DefaultKinematics is used when there is no kinematics config
+var DefaultKinematics = KinematicsConfig{
+	MotionLimits: MotionLimits{
+		MaxVelocity:          300,
+		MaxAccel:             3000,
+		SquareCornerVelocity: 5,
+	},
+	Lookahead: 32,
+}
+
+// plannedMove is a move in the lookahead queue, velocities are kept squared
+type plannedMove struct {
+	g *Gcode
+
+	length    float64
+	accel     float64
+	deviation float64
+	kinematic bool // moves the toolhead, extruder only moves are not
+
+	startDir [3]float64
+	endDir   [3]float64
+
+	maxCruiseV2 float64
+	maxStartV2  float64
+	deltaV2     float64 // the v2 could be gained over the move
+}
+
+// junction limits the start velocity of the move by the corner with the
+// previous move. This is the same as klipper.
+func (m *plannedMove) junction(prev *plannedMove) {
+	m.maxStartV2 = 0
+	if prev == nil || !m.kinematic || !prev.kinematic {
+		return
+	}
+
+	cos := -(prev.endDir[0]*m.startDir[0] + prev.endDir[1]*m.startDir[1] + prev.endDir[2]*m.startDir[2])
+	if cos > 0.999999 {
+		// reversing, comes to a stop
+		return
+	}
+	cos = math.Max(cos, -0.999999)
+	sinD2 := math.Sqrt(0.5 * (1.0 - cos))
+	rJD := sinD2 / (1.0 - sinD2)
+	tanD2 := sinD2 / math.Sqrt(0.5*(1.0+cos))
+
+	m.maxStartV2 = math.Min(
+		math.Min(rJD*m.deviation*m.accel, rJD*prev.deviation*prev.accel),
+		math.Min(0.5*m.length*tanD2*m.accel, 0.5*prev.length*tanD2*prev.accel),
+	)
+	m.maxStartV2 = math.Min(m.maxStartV2, math.Min(m.maxCruiseV2, prev.maxCruiseV2))
+	m.maxStartV2 = math.Min(m.maxStartV2, prev.maxStartV2+prev.deltaV2)
+}
+
+// time calculates the time of a trapezoid from start to end velocity.
+func (m *plannedMove) time(startV2, endV2 float64) float64 {
+	cruiseV2 := math.Min(m.maxCruiseV2, (startV2+endV2+m.deltaV2)/2)
+	if cruiseV2 <= 0 {
+		return 0
+	}
+
+	var (
+		vs = math.Sqrt(startV2)
+		ve = math.Sqrt(endV2)
+		vc = math.Sqrt(cruiseV2)
+	)
+	accelD := (cruiseV2 - startV2) / (2 * m.accel)
+	decelD := (cruiseV2 - endV2) / (2 * m.accel)
+	cruiseD := math.Max(m.length-accelD-decelD, 0)
+	return (vc-vs)/m.accel + (vc-ve)/m.accel + cruiseD/vc
+}
+
+// KinematicEstimator estimates the time of moves with trapezoidal velocity
+// profiles, with the junction and lookahead planning like the firmwares.
+type KinematicEstimator struct {
+	lookahead int
+
+	queue   []*plannedMove
+	prev    *plannedMove // last planned move, for junction
+	startV2 float64      // start velocity of the first move in the queue
+}
+
+func NewKinematicEstimator(cfg *KinematicsConfig) *KinematicEstimator {
+	e := &KinematicEstimator{
+		lookahead: cfg.Lookahead,
+	}
+	if e.lookahead <= 0 {
+		e.lookahead = DefaultKinematics.Lookahead
+	}
+	return e
+}
+
+// newMove creates a planned move with the limits in the state, nil is returned
+// if the move does not move any axis.
+func (e *KinematicEstimator) newMove(g *Gcode, state *ExtruderState) *plannedMove {
+	var (
+		limits     = &state.Limits
+		X, Y, Z, E = g.Delta(state)
+	)
+	m := &plannedMove{
+		g:         g,
+		accel:     limits.MaxAccel,
+		deviation: limits.Deviation(),
+	}
+
+	// axes contains the travel of each axis, for the per axis limits
+	var axes [4]float64
+	if g.Op == "G2" || g.Op == "G3" {
+		arc := g.Arc(state.Plane, X, Y, Z)
+		m.length = arc.Length()
+		m.startDir = arc.StartDir
+		m.endDir = arc.EndDir
+		// an arc could use the full length on the axes in the plane
+		axes = [4]float64{m.length, m.length, m.length, E}
+		switch state.Plane {
+		case PlaneZX:
+			axes[1] = arc.Linear
+		case PlaneYZ:
+			axes[0] = arc.Linear
+		default:
+			axes[2] = arc.Linear
+		}
+	} else {
+		m.length = math.Sqrt(X*X + Y*Y + Z*Z)
+		if m.length > 0 {
+			m.startDir = [3]float64{X / m.length, Y / m.length, Z / m.length}
+			m.endDir = m.startDir
+		}
+		axes = [4]float64{X, Y, Z, E}
+	}
+
+	velocity := state.Feedrate * state.SpeedFactor
+	m.kinematic = m.length > arcEpsilon
+	if m.kinematic {
+		velocity = math.Min(velocity, limits.MaxVelocity)
+		if E <= 0 && limits.TravelAccel > 0 {
+			m.accel = limits.TravelAccel
+		}
+	} else {
+		// extruder only move
+		m.length = math.Abs(E)
+		if m.length < arcEpsilon {
+			return nil
+		}
+		if limits.RetractAccel > 0 {
+			m.accel = limits.RetractAccel
+		}
+	}
+
+	if m.accel <= 0 {
+		m.accel = DefaultKinematics.MaxAccel
+	}
+
+	velocityLimits := [4]float64{limits.AxisVelocity.X, limits.AxisVelocity.Y, limits.AxisVelocity.Z, limits.AxisVelocity.E}
+	accelLimits := [4]float64{limits.AxisAccel.X, limits.AxisAccel.Y, limits.AxisAccel.Z, limits.AxisAccel.E}
+	for i, d := range axes {
+		d = math.Abs(d)
+		if d < arcEpsilon {
+			continue
+		}
+		ratio := m.length / d
+		if velocityLimits[i] > 0 {
+			velocity = math.Min(velocity, velocityLimits[i]*ratio)
+		}
+		if accelLimits[i] > 0 {
+			m.accel = math.Min(m.accel, accelLimits[i]*ratio)
+		}
+	}
+
+	m.maxCruiseV2 = velocity * velocity
+	m.deltaV2 = 2 * m.length * m.accel
+	return m
+}
+
+func (e *KinematicEstimator) Push(g *Gcode, state *ExtruderState) []*Gcode {
+	m := e.newMove(g, state)
+	if m == nil || m.maxCruiseV2 <= 0 {
+		// nothing to plan
+		g.Time = 0
+		return []*Gcode{g}
+	}
+
+	m.junction(e.prev)
+	e.prev = m
+	e.queue = append(e.queue, m)
+	g.Pending = true
+
+	return e.plan(false)
+}
+
+func (e *KinematicEstimator) Flush() []*Gcode {
+	settled := e.plan(true)
+	e.prev = nil
+	e.startV2 = 0
+	return settled
+}
+
+// plan settles the moves which will no longer be affected by the moves
+// coming later, or all moves if flush is set.
+func (e *KinematicEstimator) plan(flush bool) []*Gcode {
+	n := len(e.queue)
+	if n == 0 {
+		return nil
+	}
+
+	// backward pass: the max start velocity assuming a stop after the last move
+	var (
+		startV2 = make([]float64, n)
+		nextV2  = 0.0
+		settle  = 0
+	)
+	for i := n - 1; i >= 0; i-- {
+		m := e.queue[i]
+		reachableV2 := nextV2 + m.deltaV2
+		startV2[i] = math.Min(m.maxStartV2, reachableV2)
+		if settle == 0 && m.maxStartV2 <= reachableV2 {
+			// limited by the junction, later moves could not change
+			// anything before this move
+			settle = i
+		}
+		nextV2 = startV2[i]
+	}
+	if flush {
+		settle = n
+	} else if n-settle > e.lookahead {
+		// the planner buffer is full
+		settle = n - e.lookahead
+	}
+	if settle == 0 {
+		return nil
+	}
+
+	// forward pass: accelerate as much as we could
+	settled := make([]*Gcode, 0, settle)
+	v2 := e.startV2
+	for i := 0; i < settle; i++ {
+		m := e.queue[i]
+		s := math.Min(startV2[i], v2)
+		end := 0.0
+		if i+1 < n {
+			end = startV2[i+1]
+		}
+		end = math.Min(end, s+m.deltaV2)
+
+		m.g.Time = m.time(s, end)
+		m.g.Pending = false
+		settled = append(settled, m.g)
+		v2 = end
+	}
+	e.startV2 = v2
+	e.queue = e.queue[settle:]
+
+	return settled
+}
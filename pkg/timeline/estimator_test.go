@@ -0,0 +1,171 @@
+package timeline
+
+import (
+	"math"
+	"testing"
+)
+
+// estimate runs the moves through the estimator as the timeline does, and
+// returns the time of each move
+func estimate(t *testing.T, limits MotionLimits, lines ...string) []float64 {
+	t.Helper()
+	e := NewKinematicEstimator(&KinematicsConfig{MotionLimits: limits})
+	state := NewExtruderState()
+	state.Limits = limits
+	state.RelExtr = true
+
+	var codes []*Gcode
+	settled := 0
+	for i, line := range lines {
+		g := ParseGcode(line, int64(i+1))
+		if g.F.Valid {
+			state.Feedrate = g.F.Value
+		}
+		settled += len(e.Push(g, state))
+		state.Update(g)
+		codes = append(codes, g)
+	}
+	settled += len(e.Flush())
+	if settled != len(codes) {
+		t.Fatalf("%d moves settled, want %d", settled, len(codes))
+	}
+
+	times := make([]float64, len(codes))
+	for i, g := range codes {
+		if g.Pending {
+			t.Fatalf("move %d is still pending", i+1)
+		}
+		times[i] = g.Time
+	}
+	return times
+}
+
+func TestKinematicEstimator(t *testing.T) {
+	limits := MotionLimits{MaxVelocity: 300, MaxAccel: 1000, SquareCornerVelocity: 5}
+	// the cornering velocity of a square corner is the square corner velocity
+	corner := 5.0
+
+	tests := []struct {
+		name   string
+		limits MotionLimits
+		lines  []string
+		times  []float64
+	}{
+		{
+			// 5mm to 100mm/s, 90mm cruise, 5mm to stop
+			name:   "trapezoid",
+			limits: limits,
+			lines:  []string{"G1 X100 F6000"},
+			times:  []float64{0.1 + 0.9 + 0.1},
+		},
+		{
+			// never reaches the cruise velocity, 2mm up and 2mm down
+			name:   "triangle",
+			limits: limits,
+			lines:  []string{"G1 X4 F6000"},
+			times:  []float64{2 * math.Sqrt(2*2/1000.0)},
+		},
+		{
+			name:   "max velocity",
+			limits: MotionLimits{MaxVelocity: 100, MaxAccel: 1000},
+			lines:  []string{"G1 X100 F30000"},
+			times:  []float64{0.1 + 0.9 + 0.1},
+		},
+		{
+			// no slow down between the moves in a line
+			name:   "straight",
+			limits: limits,
+			lines:  []string{"G1 X50 F6000", "G1 X100"},
+			times:  []float64{0.1 + 0.45, 0.45 + 0.1},
+		},
+		{
+			// slows down to the corner velocity, from 100mm/s over 4.9875mm
+			name:   "square corner",
+			limits: limits,
+			lines:  []string{"G1 X100 F6000", "G1 Y100"},
+			times: []float64{
+				0.1 + (100-5-(100*100-corner*corner)/2000)/100 + (100-corner)/1000,
+				(100-corner)/1000 + (100-5-(100*100-corner*corner)/2000)/100 + 0.1,
+			},
+		},
+		{
+			// comes to a stop when reversing
+			name:   "reverse",
+			limits: limits,
+			lines:  []string{"G1 X100 F6000", "G1 X0"},
+			times:  []float64{1.1, 1.1},
+		},
+		{
+			// 0.9mm to 30mm/s at 500mm/s^2, 3.2mm cruise
+			name:   "retract",
+			limits: MotionLimits{MaxVelocity: 300, MaxAccel: 1000, RetractAccel: 500},
+			lines:  []string{"G1 E-5 F1800"},
+			times:  []float64{0.06 + 3.2/30 + 0.06},
+		},
+		{
+			// 0.5mm to 10mm/s at 100mm/s^2, 9mm cruise
+			name: "axis limits",
+			limits: MotionLimits{
+				MaxVelocity: 300, MaxAccel: 1000,
+				AxisVelocity: AxisLimits{Z: 10},
+				AxisAccel:    AxisLimits{Z: 100},
+			},
+			lines: []string{"G1 Z10 F6000"},
+			times: []float64{0.1 + 0.9 + 0.1},
+		},
+		{
+			// a half circle of 50mm radius, 5mm to 100mm/s and 5mm to stop
+			name:   "arc",
+			limits: limits,
+			lines:  []string{"G2 X100 I50 F6000"},
+			times:  []float64{0.1 + (50*math.Pi-10)/100 + 0.1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			times := estimate(t, tt.limits, tt.lines...)
+			for i := range times {
+				if math.Abs(times[i]-tt.times[i]) > 1e-9 {
+					t.Errorf("times = %v, want %v", times, tt.times)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestKinematicEstimatorLookahead(t *testing.T) {
+	limits := MotionLimits{MaxVelocity: 300, MaxAccel: 1000, SquareCornerVelocity: 5}
+	e := NewKinematicEstimator(&KinematicsConfig{MotionLimits: limits, Lookahead: 2})
+	state := NewExtruderState()
+	state.Limits = limits
+
+	// the moves which could still be slowed down by a later move are kept
+	// until the planner buffer is full
+	push := func(line string) []*Gcode {
+		g := ParseGcode(line, 1)
+		if g.F.Valid {
+			state.Feedrate = g.F.Value
+		}
+		settled := e.Push(g, state)
+		state.Update(g)
+		return settled
+	}
+	for i, line := range []string{"G1 X4 F6000", "G1 X5"} {
+		if settled := push(line); len(settled) != 0 {
+			t.Fatalf("move %d settled %d moves, want none", i+1, len(settled))
+		}
+	}
+	if settled := push("G1 X6"); len(settled) != 1 {
+		t.Fatalf("full buffer settled %d moves, want 1", len(settled))
+	}
+
+	// a corner settles the moves before it
+	if settled := push("G1 Y10"); len(settled) != 2 {
+		t.Fatalf("corner settled %d moves, want 2", len(settled))
+	}
+	if settled := e.Flush(); len(settled) != 1 {
+		t.Fatalf("flush settled %d moves, want 1", len(settled))
+	}
+}
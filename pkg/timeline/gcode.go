@@ -0,0 +1,359 @@
+package timeline
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+)
+
+type NullableFloat64 struct {
+	Value float64
+	Valid bool
+}
+
+type Gcode struct {
+	Parsed bool
+
+	Line   string      // text of the line, a visitor could change it
+	Code   *gcode.Line // the parsed line
+	LineNo int64       // line number
+	Time   float64     // for calculating print time
+
+	Pending bool // time is not settled by the estimator yet
+
+	ToolchangeCode bool    // is this a toolchange code
+	Cost           float64 // time an event takes before the gcode, the printer finishes the moves first
+
+	Op string
+
+	X NullableFloat64
+	Y NullableFloat64
+	Z NullableFloat64
+
+	E NullableFloat64
+
+	I NullableFloat64
+	J NullableFloat64
+	K NullableFloat64
+
+	S NullableFloat64
+	F NullableFloat64
+	P NullableFloat64
+	R NullableFloat64
+	T NullableFloat64
+	B NullableFloat64
+
+	Params map[string]string // klipper style KEY=VALUE params
+
+	Comment string
+
+	Err error // parse error, the line is not parsed
+}
+
+func (g *Gcode) String() string {
+	return g.Line
+}
+
+func (g *Gcode) IsMove() bool {
+	switch g.Op {
+	case "G0", "G1", "G2", "G3":
+		return true
+	}
+	return false
+}
+
+// Dwell returns the time in seconds of a G4 dwell gcode.
+// P is in milliseconds and S is in seconds for Marlin, Klipper and RRF.
+// If both are given, S wins as in Marlin and RRF.
+func (g *Gcode) Dwell() float64 {
+	if g.Op != "G4" {
+		return 0.0
+	}
+
+	var t float64
+	if g.S.Valid {
+		t = g.S.Value
+	} else if g.P.Valid {
+		t = g.P.Value / 1000.0
+	}
+	return math.Max(t, 0.0)
+}
+
+// Delta returns the relative distance of each axis from the current position
+// to the end position of the gcode. E is the filament extruded with the flow
+// factor applied.
+func (g *Gcode) Delta(cur *ExtruderState) (X, Y, Z, E float64) {
+	if g.E.Valid {
+		E = g.E.Value
+		if !cur.RelExtr {
+			E -= cur.E
+		}
+		E *= cur.FlowFactor
+	}
+
+	if g.X.Valid {
+		X = g.X.Value
+		if !cur.RelPos {
+			X -= cur.X
+		}
+	}
+	if g.Y.Valid {
+		Y = g.Y.Value
+		if !cur.RelPos {
+			Y -= cur.Y
+		}
+	}
+	if g.Z.Valid {
+		Z = g.Z.Value
+		if !cur.RelPos {
+			Z -= cur.Z
+		}
+	}
+	return
+}
+
+func (g *Gcode) Distance(cur *ExtruderState) float64 {
+	switch g.Op {
+	case "G0", "G1":
+		X, Y, Z, E := g.Delta(cur)
+		return math.Sqrt(math.Pow(X, 2) + math.Pow(Y, 2) + math.Pow(Z, 2) + math.Pow(E, 2))
+	case "G2", "G3":
+		// arc fitting gcodes
+		X, Y, Z, E := g.Delta(cur)
+		arc := g.Arc(cur.Plane, X, Y, Z)
+		return math.Sqrt(math.Pow(arc.Length(), 2) + math.Pow(E, 2))
+	}
+
+	return 0.0
+}
+
+// IsSync returns true if the gcode waits for all the moves to finish
+func (g *Gcode) IsSync() bool {
+	switch g.Op {
+	case "G4", "M400", "G28":
+		return true
+	}
+	return false
+}
+
+func (g *Gcode) HasParam() bool {
+	return g.X.Valid || g.Y.Valid || g.Z.Valid || g.E.Valid || g.I.Valid || g.J.Valid || g.K.Valid || g.F.Valid || g.S.Valid || g.P.Valid || g.R.Valid || g.T.Valid || g.B.Valid || len(g.Params) > 0
+}
+
+// Param returns a klipper style KEY=VALUE param as float
+func (g *Gcode) Param(key string) NullableFloat64 {
+	v, ok := g.Params[key]
+	if !ok {
+		return NullableFloat64{}
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return NullableFloat64{}
+	}
+	return NullableFloat64{Value: f, Valid: true}
+}
+
+// Scale scales the coordinates and the feedrate, e.g. from inches to mm
+func (g *Gcode) Scale(f float64) {
+	for _, p := range []*NullableFloat64{&g.X, &g.Y, &g.Z, &g.E, &g.I, &g.J, &g.K, &g.R, &g.F} {
+		p.Value *= f
+	}
+}
+
+// field returns the param of the letter, nil if the letter is unknown
+func (g *Gcode) field(letter string) *NullableFloat64 {
+	switch strings.ToUpper(letter) {
+	case "X":
+		return &g.X
+	case "Y":
+		return &g.Y
+	case "Z":
+		return &g.Z
+	case "E":
+		return &g.E
+	case "I":
+		return &g.I
+	case "J":
+		return &g.J
+	case "K":
+		return &g.K
+	case "F":
+		return &g.F
+	case "S":
+		return &g.S
+	case "P":
+		return &g.P
+	case "R":
+		return &g.R
+	case "T":
+		return &g.T
+	case "B":
+		return &g.B
+	}
+	return nil
+}
+
+// ParseGcode parses a line of text
+func ParseGcode(line string, lineNo int64) *Gcode {
+	return NewGcode(gcode.NewLine(line), lineNo)
+}
+
+// NewGcode converts a parsed line, it's not parsed again
+func NewGcode(l *gcode.Line, lineNo int64) (g *Gcode) {
+	g = &Gcode{Line: l.String(), Code: l, LineNo: lineNo}
+
+	if l.Err != nil {
+		g.Err = l.Err
+		var pe *gcode.ParseError
+		if errors.As(l.Err, &pe) {
+			g.Err = pe.Err
+		}
+		// keep the comment, e.g. for the layer changes
+		if i := strings.Index(g.Line, ";"); i != -1 {
+			g.Comment = g.Line[i+1:]
+		}
+		return
+	}
+	g.Comment = l.Comment
+	if l.Command == "" {
+		return
+	}
+
+	g.Op = l.Command
+	for _, p := range l.Params {
+		field := g.field(p.Key)
+		if p.Assign || len(p.Key) > 1 || field == nil || p.Type == gcode.ParamString {
+			// klipper style params, and the ones not tracked in fields
+			if g.Params == nil {
+				g.Params = make(map[string]string)
+			}
+			g.Params[p.Key] = p.String
+			continue
+		}
+
+		field.Valid = true
+		if p.Type == gcode.ParamNumber {
+			field.Value = p.Number
+			if field == &g.F {
+				field.Value /= 60.0 // convert to mm/s
+			}
+		}
+	}
+
+	g.Parsed = true
+	return
+}
+
+type GcodeCost struct {
+	Toolchange float64 `yaml:"toolchange"`
+	Retraction float64 `yaml:"retraction"`
+	Wait       float64 `yaml:"wait"`
+	Homing     float64 `yaml:"homing"`
+}
+
+type ExtruderState struct {
+	X float64
+	Y float64
+	Z float64
+	E float64
+
+	Feedrate float64
+	RelExtr  bool
+	RelPos   bool
+	Plane    Plane
+	Inches   bool
+
+	SpeedFactor float64 // M220, 1.0 is 100%
+	FlowFactor  float64 // M221, 1.0 is 100%
+
+	speedFactorBackup float64
+
+	Limits MotionLimits // limits in force
+}
+
+func NewExtruderState() *ExtruderState {
+	return &ExtruderState{
+		SpeedFactor:       1.0,
+		FlowFactor:        1.0,
+		speedFactorBackup: 1.0,
+	}
+}
+
+// SetPosition sets the position without moving, as G92.
+// All axes are reset to zero if no axis is given.
+func (s *ExtruderState) SetPosition(g *Gcode) {
+	if !g.X.Valid && !g.Y.Valid && !g.Z.Valid && !g.E.Valid {
+		s.X, s.Y, s.Z, s.E = 0, 0, 0, 0
+		return
+	}
+	if g.X.Valid {
+		s.X = g.X.Value
+	}
+	if g.Y.Valid {
+		s.Y = g.Y.Value
+	}
+	if g.Z.Valid {
+		s.Z = g.Z.Value
+	}
+	if g.E.Valid {
+		s.E = g.E.Value
+	}
+}
+
+// Home moves the axes to the home position, as G28.
+// All axes are homed if no axis is given.
+func (s *ExtruderState) Home(g *Gcode, home *HomePosition) {
+	all := !g.X.Valid && !g.Y.Valid && !g.Z.Valid
+	if all || g.X.Valid {
+		s.X = home.X
+	}
+	if all || g.Y.Valid {
+		s.Y = home.Y
+	}
+	if all || g.Z.Valid {
+		s.Z = home.Z
+	}
+}
+
+// SetSpeedFactor changes the speed factor as M220, B backs up and R restores
+// the factor as marlin.
+func (s *ExtruderState) SetSpeedFactor(g *Gcode) {
+	if g.B.Valid {
+		s.speedFactorBackup = s.SpeedFactor
+	}
+	if g.R.Valid {
+		s.SpeedFactor = s.speedFactorBackup
+	}
+	if g.S.Valid && g.S.Value > 0 {
+		s.SpeedFactor = g.S.Value / 100.0
+	}
+}
+
+func (s *ExtruderState) Update(g *Gcode) {
+	if s.RelPos {
+		s.X += g.X.Value
+		s.Y += g.Y.Value
+		s.Z += g.Z.Value
+	} else {
+		if g.X.Valid {
+			s.X = g.X.Value
+		}
+		if g.Y.Valid {
+			s.Y = g.Y.Value
+		}
+		if g.Z.Valid {
+			s.Z = g.Z.Value
+		}
+	}
+
+	if !s.RelExtr {
+		if g.E.Valid {
+			s.E = g.E.Value
+		}
+	} else {
+		s.E += g.E.Value
+	}
+}
@@ -0,0 +1,118 @@
+package timeline
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Boundary is the kinds of safe boundaries a line starts
+type Boundary int
+
+const (
+	BoundaryTravel  Boundary = 1 << iota // a travel move, not extruding
+	BoundaryLayer                        // a layer change comment
+	BoundaryFeature                      // a feature comment, e.g. ;TYPE:Perimeter
+)
+
+// snap modes of the insertion points
+const (
+	SnapAny     = "any"     // insert at any line
+	SnapTravel  = "travel"  // insert only before travel moves
+	SnapLayer   = "layer"   // insert only at layer changes
+	SnapFeature = "feature" // insert only at feature boundaries
+)
+
+// DefaultMaxShift is the default maximum shift of the insertion point, in seconds
+const DefaultMaxShift = 30.0
+
+// InsertionConfig constrains where the preheat gcodes are inserted, so the
+// macros do not run in the middle of an extrusion.
+type InsertionConfig struct {
+	Snap     string  `yaml:"snap"`
+	MaxShift float64 `yaml:"max_shift"` // seconds
+}
+
+func (c *InsertionConfig) Validate() error {
+	switch c.Snap {
+	case "":
+		c.Snap = SnapAny
+	case SnapAny, SnapTravel, SnapLayer, SnapFeature:
+	default:
+		return fmt.Errorf("unknown insertion snap: %s", c.Snap)
+	}
+	if c.MaxShift < 0 {
+		return fmt.Errorf("insertion max shift cannot be negative")
+	}
+	if c.MaxShift == 0 {
+		c.MaxShift = DefaultMaxShift
+	}
+	return nil
+}
+
+// boundary returns the boundary kind required by the snap mode
+func (c *InsertionConfig) boundary() Boundary {
+	switch c.Snap {
+	case SnapTravel:
+		return BoundaryTravel
+	case SnapLayer:
+		return BoundaryLayer
+	case SnapFeature:
+		return BoundaryFeature
+	}
+	return 0
+}
+
+// lineBoundary returns the boundary kind of a comment line
+func lineBoundary(comment string) Boundary {
+	if _, ok := layerChange(comment); ok {
+		return BoundaryLayer
+	}
+	comment = strings.TrimSpace(comment)
+	if strings.HasPrefix(comment, "TYPE:") || strings.HasPrefix(comment, "FEATURE:") {
+		return BoundaryFeature
+	}
+	return 0
+}
+
+// MaxLateShare is the maximum share of the lead time the insertion point is
+// moved later, when there is no acceptable line before it
+const MaxLateShare = 0.2
+
+// Snap moves the insertion point to an acceptable line in [lo, hi] within the
+// max shift. An earlier line costs no wait, so the nearest earlier one is
+// preferred. It's moved later only if there is none, and by at most
+// MaxLateShare of the time until hi, so it does not eat the lead time. It's
+// not moved if there is no acceptable line.
+func (t *Timeline) Snap(index, lo, hi int) int {
+	cfg := t.Insertion
+	if cfg == nil || cfg.Snap == SnapAny || index >= len(t.Lines) {
+		return index
+	}
+	want := cfg.boundary()
+	accept := func(i int) bool {
+		return t.Lines[i].Boundary&want != 0
+	}
+	if accept(index) {
+		return index
+	}
+
+	at := t.Lines[index].PrintTime
+	for i := index - 1; i >= lo && at-t.Lines[i].PrintTime <= cfg.MaxShift; i-- {
+		if accept(i) {
+			return i
+		}
+	}
+
+	late := cfg.MaxShift
+	if hi < len(t.Lines) {
+		late = math.Min(late, (t.Lines[hi].PrintTime-at)*MaxLateShare)
+	}
+	for i := index + 1; i <= hi && i < len(t.Lines) && t.Lines[i].PrintTime-at <= late; i++ {
+		if accept(i) {
+			return i
+		}
+	}
+	t.Log.Warnf("no %s boundary within %.1fs of line %d, insert there", cfg.Snap, cfg.MaxShift, index+1)
+	return index
+}
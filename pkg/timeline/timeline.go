@@ -0,0 +1,336 @@
+package timeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+	"github.com/sirupsen/logrus"
+)
+
+// Line is a line of the gcode file, with the time tracked in the first pass.
+// The parsed lines are not kept, the ones as read are parsed again when they
+// are emitted, so a whole file of parsed lines is not kept in memory.
+type Line struct {
+	Text      string  // text of the line, could be changed into several lines
+	EOL       string  // line ending of the line read
+	Time      float64 // time to execute this line
+	PrintTime float64 // cumulative time when this line starts
+	Move      bool
+	Boundary  Boundary // safe boundaries to insert before this line
+}
+
+// Visitor observes each gcode before it's recorded by the timeline. It could
+// change the line, or mark it as a toolchange with the time it takes.
+type Visitor interface {
+	Visit(g *Gcode) error
+}
+
+// Scheduler is a visitor which inserts gcodes into the timeline after the
+// time of all the lines is known.
+type Scheduler interface {
+	Visitor
+	Plan() error
+}
+
+// Timeline tracks the time of each line of a gcode file, so gcodes could be
+// inserted a certain time before a line.
+type Timeline struct {
+	Costs      *GcodeCost
+	Kinematics *KinematicsConfig
+	Insertion  *InsertionConfig
+	Log        logrus.FieldLogger
+
+	// state tracking
+	State     *ExtruderState
+	Estimator Estimator
+	Layer     int // current layer number, 0 before the first layer
+
+	// gcode tracking
+	PrintTime float64 // print time of all processed gcodes
+	Lines     []Line
+
+	// the lines pushed not as read, e.g. edited by a processor before, they
+	// are emitted as they were pushed if the text is not changed
+	Codes map[int]*gcode.Line
+	// lines to insert before the line at the index
+	Inserts map[int][]string
+	// comments appended to the line at the index, for debugging
+	Comments map[int]string
+}
+
+// NewTimeline creates a timeline, the moves are estimated with the
+// kinematics, or the rough ratio if it's positive. Nothing is logged if the
+// logger is nil.
+func NewTimeline(costs *GcodeCost, kinematics *KinematicsConfig, insertion *InsertionConfig, speedChangeRatio float64, log logrus.FieldLogger) *Timeline {
+	if kinematics == nil {
+		kinematics = &DefaultKinematics
+	}
+	t := &Timeline{
+		Costs:      costs,
+		Kinematics: kinematics,
+		Insertion:  insertion,
+		Log:        Logger(log),
+		State:      NewExtruderState(),
+		Codes:      make(map[int]*gcode.Line),
+		Inserts:    make(map[int][]string),
+		Comments:   make(map[int]string),
+	}
+	t.State.Limits = kinematics.Limits()
+	if speedChangeRatio > 0 {
+		t.Estimator = &RatioEstimator{Ratio: speedChangeRatio}
+	} else {
+		t.Estimator = NewKinematicEstimator(kinematics)
+	}
+	return t
+}
+
+// Add appends a line to the timeline, the visitors observe it before it's
+// recorded. Settle must be called after the last line.
+func (t *Timeline) Add(line *gcode.Line, visitors ...Visitor) error {
+	lineNo := int64(len(t.Lines) + 1)
+	g := NewGcode(line, lineNo)
+	if g.Err != nil {
+		t.Log.Debugf("line %d: %v", lineNo, g.Err)
+	}
+
+	if layer, ok := layerChange(g.Comment); ok {
+		if layer < 0 {
+			layer = t.Layer + 1
+		}
+		t.Layer = layer
+	}
+
+	for _, v := range visitors {
+		if err := v.Visit(g); err != nil {
+			return err
+		}
+	}
+
+	if line.Edited() || line.Err != nil || line.EOL == "" {
+		// a new line has no line ending either, unlike the last line read
+		t.Codes[len(t.Lines)] = line
+	}
+	t.Lines = append(t.Lines, Line{Text: g.Line, EOL: line.EOL, Move: g.IsMove(), Boundary: lineBoundary(g.Comment)})
+
+	// toolchanges and events could be matched by regex even if not parsed
+	if !g.Parsed && !g.ToolchangeCode && g.Cost == 0 {
+		return nil
+	}
+	if g.Cost > 0 {
+		// the printer finishes the moves before the event
+		t.settle(t.Estimator.Flush())
+	}
+
+	// convert to mm, all the states are kept in mm
+	if t.State.Inches && (g.IsMove() || g.Op == "G92") {
+		g.Scale(25.4)
+	}
+
+	switch {
+	case g.ToolchangeCode:
+		// the time is set by the visitor
+	case g.Op == "M82":
+		t.State.RelExtr = false
+		t.Log.Infof("change to absolute extruder mode")
+	case g.Op == "M83":
+		t.State.RelExtr = true
+		t.Log.Infof("change to relative extruder mode")
+	case g.Op == "G90":
+		t.State.RelPos = false
+		t.Log.Infof("change to absolute position mode")
+	case g.Op == "G91":
+		t.State.RelPos = true
+		t.Log.Infof("change to relative position mode")
+	case g.Op == "M201" || g.Op == "M203" || g.Op == "M204" || g.Op == "M205" || g.Op == "SET_VELOCITY_LIMIT":
+		t.State.Limits.Update(g)
+		t.Log.Debugf("motion limits changed: %+v", t.State.Limits)
+	case g.Op == "G20":
+		t.State.Inches = true
+		t.Log.Infof("change to inch units")
+	case g.Op == "G21":
+		t.State.Inches = false
+		t.Log.Infof("change to millimeter units")
+	case g.Op == "G92":
+		t.State.SetPosition(g)
+	case g.Op == "G28":
+		t.State.Home(g, &t.Kinematics.Home)
+		if t.Costs != nil {
+			g.Time = t.Costs.Homing
+		}
+	case g.Op == "M220":
+		t.State.SetSpeedFactor(g)
+	case g.Op == "M221":
+		if g.S.Valid {
+			t.State.FlowFactor = g.S.Value / 100.0
+		}
+	case g.Op == "G17":
+		t.State.Plane = PlaneXY
+	case g.Op == "G18":
+		t.State.Plane = PlaneZX
+	case g.Op == "G19":
+		t.State.Plane = PlaneYZ
+	case g.Op == "G10" || g.Op == "G11":
+		if t.Costs != nil {
+			g.Time = t.Costs.Retraction
+		}
+	case g.Op == "G4":
+		g.Time = g.Dwell()
+	case g.Op == "M400":
+		// waits for the moves to finish, the moves are already counted
+		if t.Costs != nil {
+			g.Time = t.Costs.Wait
+		}
+	case g.IsMove():
+		// time of moves is calculated by the estimator
+		if g.F.Valid {
+			t.State.Feedrate = g.F.Value
+		}
+		if _, _, _, e := g.Delta(t.State); e <= 0 {
+			t.Lines[lineNo-1].Boundary |= BoundaryTravel
+		}
+		t.settle(t.Estimator.Push(g, t.State))
+
+		t.State.Update(g)
+	}
+
+	if !g.IsMove() && (g.Time > 0 || g.Cost > 0 || g.ToolchangeCode || g.IsSync()) {
+		// the printer finishes all the moves before this gcode
+		t.settle(t.Estimator.Flush())
+		t.Lines[lineNo-1].Time = g.Time + g.Cost
+	}
+	return nil
+}
+
+// Settle settles the time of the pending moves, and the print time of each
+// line after the last line is added.
+func (t *Timeline) Settle() {
+	t.settle(t.Estimator.Flush())
+
+	// this is essential:
+	// by encoding each line with the print time, we could find the line
+	// at a certain time before a toolchange
+	t.PrintTime = 0
+	for i := range t.Lines {
+		t.Lines[i].PrintTime = t.PrintTime
+		t.PrintTime += t.Lines[i].Time
+	}
+}
+
+// settle records the time of the gcodes settled by the estimator
+func (t *Timeline) settle(codes []*Gcode) {
+	for _, c := range codes {
+		t.Lines[c.LineNo-1].Time = c.Time + c.Cost
+	}
+}
+
+// layerChange returns the layer number of a layer change comment, -1 for the
+// next layer if the comment has no number.
+func layerChange(comment string) (int, bool) {
+	comment = strings.TrimSpace(comment)
+	switch {
+	case comment == "LAYER_CHANGE" || comment == "CHANGE_LAYER":
+		return -1, true
+	case strings.HasPrefix(comment, "LAYER:"):
+		// layers start from 0 in cura
+		layer, err := strconv.Atoi(strings.TrimSpace(comment[len("LAYER:"):]))
+		if err != nil {
+			return 0, false
+		}
+		return layer + 1, true
+	}
+	return 0, false
+}
+
+// LineAt returns the index of the first line starts at or after the time
+func (t *Timeline) LineAt(at float64) int {
+	return sort.Search(len(t.Lines), func(i int) bool {
+		return t.Lines[i].PrintTime >= at
+	})
+}
+
+// LineBefore returns the index of the last line starts at or before the time
+func (t *Timeline) LineBefore(at float64) int {
+	index := t.LineAt(at)
+	if index >= len(t.Lines) || (index > 0 && t.Lines[index].PrintTime > at) {
+		index--
+	}
+	return index
+}
+
+// Insert adds the gcode before the line at the index
+func (t *Timeline) Insert(index int, code string) {
+	t.Inserts[index] = append(t.Inserts[index], code)
+}
+
+// Emit emits the lines with the inserted gcodes one by one, the multi-line
+// gcodes are split into lines. The lines not changed are emitted as they were
+// pushed.
+func (t *Timeline) Emit(emit func(line *gcode.Line) error) error {
+	lines := func(code string) error {
+		for _, line := range strings.Split(code, "\n") {
+			if err := emit(gcode.NewLine(line)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i, line := range t.Lines {
+		for _, code := range t.Inserts[i] {
+			if err := lines(code); err != nil {
+				return err
+			}
+		}
+		var err error
+		code, ok := t.Codes[i]
+		switch comment := t.Comments[i]; {
+		case comment == "" && ok && line.Text == code.String():
+			err = emit(code)
+		case comment == "" && !ok && !strings.Contains(line.Text, "\n"):
+			// the line read, or changed into another line with its line ending
+			err = emit(gcode.ReadLine(line.Text, line.EOL, int64(i+1)))
+		default:
+			err = lines(line.Text + comment)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// inserted after the last line
+	for _, code := range t.Inserts[len(t.Lines)] {
+		if err := lines(code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes out the lines with the inserted gcodes.
+func (t *Timeline) Write(w io.Writer) error {
+	gw := gcode.NewWriter(w)
+	err := t.Emit(gw.Write)
+	if err == nil {
+		err = gw.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write gcode: %w", err)
+	}
+	return nil
+}
+
+// Logger returns the logger, or one discarding everything if it's nil, so
+// nothing is logged to the global logger.
+func Logger(log logrus.FieldLogger) logrus.FieldLogger {
+	if log != nil {
+		return log
+	}
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+	l.SetLevel(logrus.PanicLevel)
+	return l
+}
@@ -0,0 +1,52 @@
+package timeline
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/alexjx/gcodeproc/pkg/gcode"
+)
+
+func TestEmit(t *testing.T) {
+	input := "G1 X0 Y0 F1800\r\nG1 X10 E1 (c)\r\nM98 P\"x\r\nM117 hi\r\nG1 X20 E1"
+	tl := NewTimeline(nil, nil, nil, 0, nil)
+	r := gcode.NewReader(strings.NewReader(input))
+	for {
+		l, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if r.LineNo() == 2 {
+			// edited by a processor before
+			l.Scale("E", 2)
+		}
+		if err := tl.Add(l); err != nil {
+			t.Fatalf("failed to add: %v", err)
+		}
+	}
+	tl.Settle()
+	tl.Insert(1, "M400")
+	tl.Lines[3].Text = "M117 bye"
+
+	// only the edited, the malformed, and the last line without line ending
+	// are kept parsed
+	for i := range tl.Lines {
+		if _, ok := tl.Codes[i]; ok != (i == 1 || i == 2 || i == 4) {
+			t.Errorf("line %d is kept parsed %v", i+1, ok)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := tl.Write(&b); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	want := "G1 X0 Y0 F1800\r\nM400\nG1 X10 E2 (c)\r\nM98 P\"x\r\nM117 bye\r\nG1 X20 E1"
+	if b.String() != want {
+		t.Errorf("output %q, want %q", b.String(), want)
+	}
+}
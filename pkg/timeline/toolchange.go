@@ -0,0 +1,82 @@
+package timeline
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ToolchangeMatch is a rule to identify the toolchange of an extruder. All
+// the fields given must match:
+//
+//	op: T1                      # opcode, e.g. T1, M6, SELECT_TOOL
+//	params: {T: 1}              # params, letter params or klipper KEY=VALUE params
+//	regex: '^M620 S1A'          # regular expression on the line
+type ToolchangeMatch struct {
+	Op     string            `yaml:"op"`
+	Params map[string]string `yaml:"params"`
+	Regex  string            `yaml:"regex"`
+
+	regex *regexp.Regexp
+}
+
+func (m *ToolchangeMatch) Compile() error {
+	if m.Op == "" && m.Regex == "" && len(m.Params) == 0 {
+		return fmt.Errorf("empty toolchange match")
+	}
+	if m.Regex != "" {
+		re, err := regexp.Compile(m.Regex)
+		if err != nil {
+			return fmt.Errorf("failed to compile toolchange regex: %w", err)
+		}
+		m.regex = re
+	}
+	return nil
+}
+
+func (m *ToolchangeMatch) Match(g *Gcode) bool {
+	if m.Op != "" && !strings.EqualFold(m.Op, g.Op) {
+		return false
+	}
+	if m.regex != nil && !m.regex.MatchString(g.Line) {
+		return false
+	}
+	for key, want := range m.Params {
+		if !matchParam(g, strings.ToUpper(key), want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Groups returns the submatches of the regex on the line, nil without regex
+func (m *ToolchangeMatch) Groups(g *Gcode) []string {
+	if m.regex == nil {
+		return nil
+	}
+	return m.regex.FindStringSubmatch(g.Line)
+}
+
+// matchParam compares a param numerically if possible, or as a string
+func matchParam(g *Gcode, key, want string) bool {
+	var (
+		value string
+		found bool
+	)
+	if v, ok := g.Params[key]; ok {
+		value, found = v, true
+	} else if field := g.field(key); len(key) == 1 && field != nil && field.Valid {
+		value, found = strconv.FormatFloat(field.Value, 'f', -1, 64), true
+	}
+	if !found {
+		return false
+	}
+
+	wantF, err1 := strconv.ParseFloat(want, 64)
+	valueF, err2 := strconv.ParseFloat(value, 64)
+	if err1 == nil && err2 == nil {
+		return wantF == valueF
+	}
+	return strings.EqualFold(want, value)
+}
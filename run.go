@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/alexjx/gcodeproc/pkg/pipeline"
+	"github.com/alexjx/gcodeproc/pkg/preheat"
+	"github.com/alexjx/gcodeproc/pkg/schedule"
+	"github.com/alexjx/gcodeproc/pkg/substitute"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+var runCmd = &cli.Command{
+	Name:    "run",
+	Aliases: []string{"pipeline"},
+	Usage:   "run the steps of the config in order, with one read and one write of the gcode file",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:     "config",
+			Usage:    "config file",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:  "log",
+			Usage: "log file",
+		},
+		&cli.IntFlag{
+			Name:  "precision",
+			Usage: "decimal places of the numbers edited in the gcode file, 5 by default, -1 for the shortest exact form",
+		},
+		&cli.Float64Flag{
+			Name:  "speed-change-ratio",
+			Usage: "use rough estimation with ratio of time in speed change phase of each move, instead of kinematics",
+		},
+
+		// debug flags
+		&cli.BoolFlag{
+			Name:   "no-rename",
+			Value:  false,
+			Hidden: true,
+		},
+		&cli.BoolFlag{
+			Name:   "debug",
+			Value:  false,
+			Hidden: true,
+		},
+	},
+	Args:      true,
+	ArgsUsage: "<gcode file>",
+	Action: func(cctx *cli.Context) error {
+		gcodePath := cctx.Args().First()
+		if gcodePath == "" {
+			return fmt.Errorf("missing gcode file")
+		}
+
+		var (
+			cfg     Config
+			cfgPath = cctx.Path("config")
+		)
+		m, err := loadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		if err := decodeConfig(m, &cfg); err != nil {
+			return err
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		// setup logging
+		logfile := cctx.Path("log")
+		if err := setupLogging(logfile); err != nil {
+			return err
+		}
+
+		opts := &StepOptions{
+			Debug:  cctx.Bool("debug"),
+			Logger: logrus.StandardLogger(),
+		}
+		if cctx.IsSet("speed-change-ratio") {
+			opts.SpeedChangeRatio = cctx.Float64("speed-change-ratio")
+		}
+
+		p := cfg.Pipeline(opts)
+		err = processFile(gcodePath, ".pipeline", !cctx.Bool("no-rename"), func(r io.Reader, w io.Writer) error {
+			return pipeline.Run(r, w, p, &pipeline.Options{Precision: precisionFlag(cctx)})
+		})
+		if err != nil {
+			logrus.Errorf("failed to run pipeline: %v", err)
+			return err
+		}
+
+		return nil
+	},
+}
+
+// PipelineStep is a step of the pipeline, only one of the processors is set,
+// or the section of the config to use. It could be written as the name of
+// the section only, e.g. "- preheat".
+type PipelineStep struct {
+	Name       string             `yaml:"name"` // optional, for the logs
+	Use        string             `yaml:"use"`  // substitute, preheat or schedule section
+	Substitute *substitute.Config `yaml:"substitute"`
+	Preheat    *preheat.Config    `yaml:"preheat"`
+	Schedule   *schedule.Config   `yaml:"schedule"`
+}
+
+func (s *PipelineStep) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&s.Use)
+	}
+	type plain PipelineStep
+	return node.Decode((*plain)(s))
+}
+
+// Config is the config file of all the commands, with a section for each
+// processor, and the steps to run in order. The lines output by a step are
+// the input of the next one, e.g. preheat after the substitutions sees the
+// substituted lines. Without steps, the sections are run in the order of
+// substitute, preheat and schedule.
+type Config struct {
+	Substitute *substitute.Config `yaml:"substitute"`
+	Preheat    *preheat.Config    `yaml:"preheat"`
+	Schedule   *schedule.Config   `yaml:"schedule"`
+	Steps      []*PipelineStep    `yaml:"steps"`
+}
+
+// StepOptions are the settings of the steps, besides the config
+type StepOptions struct {
+	SpeedChangeRatio float64
+	Debug            bool
+	Logger           logrus.FieldLogger
+}
+
+// Validate checks the config, and fills the defaults
+func (cfg *Config) Validate() error {
+	if len(cfg.Steps) == 0 {
+		for _, section := range []struct {
+			name string
+			set  bool
+		}{
+			{"substitute", cfg.Substitute != nil},
+			{"preheat", cfg.Preheat != nil},
+			{"schedule", cfg.Schedule != nil},
+		} {
+			if section.set {
+				cfg.Steps = append(cfg.Steps, &PipelineStep{Use: section.name})
+			}
+		}
+	}
+	if len(cfg.Steps) == 0 {
+		return fmt.Errorf("no steps or sections defined")
+	}
+
+	// the sections used by several steps are validated once
+	validated := make(map[interface{ Validate() error }]bool)
+	validate := func(c interface{ Validate() error }) error {
+		if validated[c] {
+			return nil
+		}
+		validated[c] = true
+		return c.Validate()
+	}
+
+	for i, step := range cfg.Steps {
+		if step.Name == "" {
+			step.Name = step.Use
+		}
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step %d", i+1)
+		}
+		if step.Use != "" {
+			if err := cfg.use(step); err != nil {
+				return fmt.Errorf("%s: %w", step.Name, err)
+			}
+		}
+
+		var (
+			count int
+			err   error
+		)
+		if step.Substitute != nil {
+			count++
+			err = validate(step.Substitute)
+		}
+		if step.Preheat != nil {
+			count++
+			err = validate(step.Preheat)
+		}
+		if step.Schedule != nil {
+			count++
+			err = validate(step.Schedule)
+		}
+		if count != 1 {
+			return fmt.Errorf("%s: exactly one of substitute, preheat or schedule must be set", step.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", step.Name, err)
+		}
+	}
+	return nil
+}
+
+// use sets the processor of the step to the section of the config
+func (cfg *Config) use(step *PipelineStep) error {
+	if step.Substitute != nil || step.Preheat != nil || step.Schedule != nil {
+		return fmt.Errorf("use could not be set with substitute, preheat or schedule")
+	}
+	switch step.Use {
+	case "substitute":
+		step.Substitute = cfg.Substitute
+	case "preheat":
+		step.Preheat = cfg.Preheat
+	case "schedule":
+		step.Schedule = cfg.Schedule
+	default:
+		return fmt.Errorf("unknown section %s", step.Use)
+	}
+	if step.Substitute == nil && step.Preheat == nil && step.Schedule == nil {
+		return fmt.Errorf("no %s section defined", step.Use)
+	}
+	return nil
+}
+
+// Pipeline creates the processors of the steps
+func (cfg *Config) Pipeline(opts *StepOptions) *pipeline.Pipeline {
+	p := pipeline.New()
+	for _, step := range cfg.Steps {
+		log := opts.Logger.WithField("step", step.Name)
+		switch {
+		case step.Substitute != nil:
+			p.Processors = append(p.Processors, substitute.NewProcessor(step.Substitute, &substitute.Options{
+				Logger: log,
+			}))
+		case step.Preheat != nil:
+			p.Processors = append(p.Processors, preheat.NewProcessor(step.Preheat, &preheat.Options{
+				SpeedChangeRatio: opts.SpeedChangeRatio,
+				Debug:            opts.Debug,
+				Logger:           log,
+			}))
+		case step.Schedule != nil:
+			p.Processors = append(p.Processors, schedule.NewProcessor(step.Schedule, &schedule.Options{
+				SpeedChangeRatio: opts.SpeedChangeRatio,
+				Debug:            opts.Debug,
+				Logger:           log,
+			}))
+		}
+	}
+	return p
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/alexjx/gcodeproc/pkg/schedule"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+var scheduleCmd = &cli.Command{
+	Name:  "schedule",
+	Usage: "insert actions a lead time before the events in a gcode file",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:     "config",
+			Usage:    "config file",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:  "log",
+			Usage: "log file",
+		},
+		&cli.IntFlag{
+			Name:  "precision",
+			Usage: "decimal places of the numbers edited in the gcode file, 5 by default, -1 for the shortest exact form",
+		},
+		&cli.Float64Flag{
+			Name:  "speed-change-ratio",
+			Usage: "use rough estimation with ratio of time in speed change phase of each move, instead of kinematics",
+		},
+
+		// debug flags
+		&cli.BoolFlag{
+			Name:   "no-rename",
+			Value:  false,
+			Hidden: true,
+		},
+		&cli.BoolFlag{
+			Name:   "debug",
+			Value:  false,
+			Hidden: true,
+		},
+	},
+	Args:      true,
+	ArgsUsage: "<gcode file>",
+	Action: func(cctx *cli.Context) error {
+		gcodePath := cctx.Args().First()
+		if gcodePath == "" {
+			return fmt.Errorf("missing gcode file")
+		}
+
+		var (
+			cfg     schedule.Config
+			cfgPath = cctx.Path("config")
+		)
+		if err := loadSection(cfgPath, "schedule", &cfg); err != nil {
+			return err
+		}
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+
+		// setup logging
+		logfile := cctx.Path("log")
+		if err := setupLogging(logfile); err != nil {
+			return err
+		}
+
+		opts := &schedule.Options{
+			Debug:     cctx.Bool("debug"),
+			Logger:    logrus.StandardLogger(),
+			Precision: precisionFlag(cctx),
+		}
+		if cctx.IsSet("speed-change-ratio") {
+			opts.SpeedChangeRatio = cctx.Float64("speed-change-ratio")
+		}
+
+		err := processFile(gcodePath, ".schedule", !cctx.Bool("no-rename"), func(r io.Reader, w io.Writer) error {
+			_, err := schedule.Schedule(r, w, &cfg, opts)
+			return err
+		})
+		if err != nil {
+			logrus.Errorf("failed to schedule: %v", err)
+			return err
+		}
+
+		return nil
+	},
+}
@@ -1,18 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
+	"io"
 	"os"
-	"regexp"
-	"strings"
-	"text/template"
 
-	"github.com/Masterminds/sprig/v3"
+	"github.com/alexjx/gcodeproc/pkg/substitute"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"gopkg.in/yaml.v3"
 )
 
 var substituteCmd = &cli.Command{
@@ -29,6 +24,10 @@ var substituteCmd = &cli.Command{
 			Name:  "log",
 			Usage: "log file",
 		},
+		&cli.IntFlag{
+			Name:  "precision",
+			Usage: "decimal places of the numbers edited in the gcode file, 5 by default, -1 for the shortest exact form",
+		},
 	},
 	Args:      true,
 	ArgsUsage: "<gcode file>",
@@ -39,17 +38,14 @@ var substituteCmd = &cli.Command{
 		}
 
 		var (
-			cfg     SubstitutionConfig
+			cfg     substitute.Config
 			cfgPath = cctx.Path("config")
 		)
-		cfgFp, err := os.Open(cfgPath)
-		if err != nil {
-			return fmt.Errorf("failed to open config file: %w", err)
+		if err := loadSection(cfgPath, "substitute", &cfg); err != nil {
+			return err
 		}
-		defer cfgFp.Close()
-
-		if err := yaml.NewDecoder(cfgFp).Decode(&cfg); err != nil {
-			return fmt.Errorf("failed to decode config file: %w", err)
+		if err := cfg.Validate(); err != nil {
+			return err
 		}
 
 		// setup logging
@@ -58,7 +54,21 @@ var substituteCmd = &cli.Command{
 			return err
 		}
 
-		if err := substitute(gcodePath, &cfg); err != nil {
+		// dump env
+		logrus.Debugf("gcodePath: %s", gcodePath)
+		for _, e := range os.Environ() {
+			logrus.Debugf("env: %s", e)
+		}
+
+		opts := &substitute.Options{
+			Logger:    logrus.StandardLogger(),
+			Precision: precisionFlag(cctx),
+		}
+		err := processFile(gcodePath, ".procssed", true, func(r io.Reader, w io.Writer) error {
+			_, err := substitute.Substitute(r, w, &cfg, opts)
+			return err
+		})
+		if err != nil {
 			logrus.Errorf("failed to substitute: %v", err)
 			return err
 		}
@@ -66,106 +76,3 @@ var substituteCmd = &cli.Command{
 		return nil
 	},
 }
-
-type Substitution struct {
-	From string `yaml:"from"`
-	To   string `yaml:"to"`
-
-	fromRegex *regexp.Regexp
-	template  *template.Template
-}
-
-type SubstitutionConfig struct {
-	Substitutions []*Substitution `yaml:"substitutions"`
-}
-
-type TemplateContext struct {
-	Matches [][]string
-}
-
-func substitute(gcodePath string, cfg *SubstitutionConfig) error {
-	// dump env
-	logrus.Debugf("gcodePath: %s", gcodePath)
-	for _, e := range os.Environ() {
-		logrus.Debugf("env: %s", e)
-	}
-
-	// preparations
-	for _, s := range cfg.Substitutions {
-		s.fromRegex = regexp.MustCompile(s.From)
-		tt := template.New(s.From).Funcs(sprig.TxtFuncMap())
-		tt, err := tt.Parse(s.To)
-		if err != nil {
-			return fmt.Errorf("failed to parse template: %w", err)
-		}
-		s.template = tt
-	}
-
-	// open input and output files
-	fp, err := os.Open(gcodePath)
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer fp.Close()
-
-	outFp, err := os.Create(gcodePath + ".procssed")
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
-	}
-	defer outFp.Close()
-
-	// scan gcode one line at a time
-	scanner := bufio.NewScanner(fp)
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		var (
-			matchesAny bool
-			matches    = make([][]string, len(cfg.Substitutions))
-		)
-		for i, s := range cfg.Substitutions {
-			matches[i] = s.fromRegex.FindStringSubmatch(line)
-			if len(matches[i]) > 0 {
-				matchesAny = true
-			}
-		}
-		if !matchesAny {
-			// no match, write line as is
-			outFp.WriteString(line + "\n")
-			continue
-		}
-
-		// provide matches as template data
-		data := &TemplateContext{
-			Matches: matches,
-		}
-
-		// render template into a temporary buffer
-		for _, s := range cfg.Substitutions {
-			var b bytes.Buffer
-			w := bufio.NewWriter(&b)
-			if err := s.template.Execute(w, data); err != nil {
-				return fmt.Errorf("failed to execute template: %w", err)
-			}
-			w.Flush()
-
-			ts := strings.ReplaceAll(b.String(), "\\n", "\n")
-			line = s.fromRegex.ReplaceAllString(line, ts)
-		}
-		outFp.WriteString(line + "\n")
-	}
-
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("failed to scan input file: %w", err)
-	}
-
-	fp.Close()
-	outFp.Close()
-
-	// rename output file to input file
-	if err := os.Rename(outFp.Name(), fp.Name()); err != nil {
-		return fmt.Errorf("failed to rename output file: %w", err)
-	}
-
-	return nil
-}